@@ -2,14 +2,17 @@ package bridge
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/sipb/mm2zephyr/markup"
 	"github.com/sipb/mm2zephyr/mm"
 	"github.com/sipb/mm2zephyr/prettier"
 	"github.com/sipb/mm2zephyr/zephyr"
@@ -21,53 +24,195 @@ import (
 type Config struct {
 	Mattermost      MattermostConfig       `yaml:"mattermost"`
 	PrettierOptions map[string]interface{} `yaml:"prettier"`
+	// PrettierContexts is how many messages can be formatted with prettier at
+	// once. Each one costs a JavaScript context. Defaults to 1.
+	PrettierContexts int `yaml:"prettier_contexts"`
+	// PrettierLimits bounds the time and memory spent formatting messages.
+	// Messages that can't be formatted within the limits are sent unformatted.
+	PrettierLimits prettier.Limits `yaml:"prettier_limits"`
+	State          StateConfig     `yaml:"state"`
+	// ThreadTimeout is how long an instance can be idle before a new zephyr on it
+	// starts a new Mattermost thread instead of replying to the previous one.
+	// Zero means threads never expire. Mappings may override this.
+	ThreadTimeout time.Duration `yaml:"thread_timeout"`
 	// Mappings represents the list of Mattermost channel to Zephyr triplet pairings.
 	// If multiple mappings match a Zephyrgram, the first one will be used.
 	Mappings []Mapping `yaml:"mappings"`
+	// HeaderMappings bridges channels according to their headers, after Mappings.
+	HeaderMappings HeaderMappingsConfig `yaml:"header_mappings"`
+	// Personals lists the people who can exchange personal messages through
+	// the bridge, with their Zephyr and Mattermost usernames.
+	Personals []Personal `yaml:"personals"`
 }
 
 // MattermostConfig represents the configuration for connecting to Mattermost.
 type MattermostConfig struct {
 	URL string `yaml:"url"`
+	// Teams names the teams whose channels are bridged. Mappings are on the
+	// first team unless they name another. Defaults to the "sipb" team.
+	Teams []string `yaml:"teams"`
+}
+
+// teams returns the configured teams, the first of which is the default team.
+func (config MattermostConfig) teams() []string {
+	if len(config.Teams) == 0 {
+		return []string{"sipb"}
+	}
+	return config.Teams
 }
 
 // Mapping objects represent a single pairing of Mattermost channel and Zephyr triplet.
 type Mapping struct {
-	Channel  string `yaml:"channel"`
-	Class    string `yaml:"class"`
+	Channel string `yaml:"channel"`
+	// Team is the team Channel and the diversion channels are on, if not the
+	// default team.
+	Team  string `yaml:"team"`
+	Class string `yaml:"class"`
+	// Instance selects the instances on Class that are bridged. It is empty or
+	// "*" for all of them, a single instance, a glob in which * matches any run
+	// of characters and ? any one character (like "help.*"), or a regular
+	// expression between slashes (like "/help(\..*)?/"). Patterns must match
+	// the whole instance, ignoring case. Mattermost posts in a channel whose
+	// mapping has a pattern name their instance like those in a class-wide
+	// channel do, and are dropped unless the pattern matches it.
 	Instance string `yaml:"instance"`
 	// The diversion map maps Zephyr usernames to alternative Mattermost channels.
 	// This is useful, for example, to redirect high-spew automated messages to
 	// another channel so that the main channel is usable.
 	Diversions map[string]string `yaml:"diversions"`
+	// Private must be set to bridge a private channel, and only a private
+	// channel, so that a mistyped channel name can't bridge one. The bot never
+	// joins a private channel itself; it has to be invited. Diversion channels
+	// must still be public.
+	Private bool `yaml:"private"`
+	// ThreadTimeout overrides Config.ThreadTimeout for this mapping.
+	ThreadTimeout time.Duration `yaml:"thread_timeout"`
+	// Authenticated sends Mattermost posts as zephyrs authenticated as the
+	// bridge's own principal, with the author named in the zsig, instead of
+	// unauthenticated zephyrs claiming to be from the author, which many
+	// clients flag as forged.
+	Authenticated bool `yaml:"authenticated"`
+	// RequireAuth drops zephyrs that aren't authenticated, instead of bridging
+	// them with their sender marked as unauthenticated or forged.
+	RequireAuth bool `yaml:"require_auth"`
+	// Reactions enables sending a short zephyr when someone reacts to a post
+	// in the channel, like "alice reacted :+1: to <link>". Reactions on an
+	// instance are collected for a while and sent together.
+	Reactions bool `yaml:"reactions"`
+	// Retractions enables sending a notice to Zephyr when a bridged
+	// Mattermost post is deleted.
+	Retractions bool `yaml:"retractions"`
+	// Variants also bridges the classes formed by prefixing "un" to Class and
+	// appending ".d", up to twice each, like "unsipb", "ununsipb", "sipb.d" and
+	// "unsipb.d.d". Zephyrs on a variant are marked with their class in
+	// Mattermost. Mattermost posts go to a variant when they start with a
+	// "[-c unsipb]" prefix or reply in one of its threads.
+	Variants bool `yaml:"variants"`
+	// Direction limits which way messages are bridged: "zephyr-to-mattermost",
+	// "mattermost-to-zephyr", or "both" (the default).
+	Direction string `yaml:"direction"`
+	// Format selects how Mattermost messages are rendered for Zephyr:
+	// "markdown" (the default) re-wraps the Markdown with prettier, and
+	// "zephyr" converts it to Zephyr markup.
+	Format string `yaml:"format"`
+
+	// fromHeader is set on mappings read from a channel header rather than the configuration.
+	fromHeader bool
+}
+
+// Values for Mapping.Format.
+const (
+	formatMarkdown = "markdown"
+	formatZephyr   = "zephyr"
+)
+
+// Values for Mapping.Direction.
+const (
+	directionBoth               = "both"
+	directionZephyrToMattermost = "zephyr-to-mattermost"
+	directionMattermostToZephyr = "mattermost-to-zephyr"
+)
+
+// toMattermost reports whether the mapping bridges zephyrs to Mattermost.
+func (mapping Mapping) toMattermost() bool {
+	return mapping.Direction != directionMattermostToZephyr
+}
+
+// toZephyr reports whether the mapping bridges Mattermost posts to Zephyr.
+func (mapping Mapping) toZephyr() bool {
+	return mapping.Direction != directionZephyrToMattermost
+}
+
+// Personal objects pair one person's Zephyr and Mattermost usernames. Listed
+// people can write to each other through the bridge, naming the recipient by
+// either of their usernames: a personal zephyr to the bridge's principal goes
+// to the person named by its instance (zwrite -i alice), or by a "[@alice]"
+// prefix if the instance is "personal", as a direct message from the bot. A
+// direct message to the bot goes to the person named by its "[@alice]"
+// prefix as a personal zephyr, on an instance naming the sender so that a
+// reply on it comes back.
+type Personal struct {
+	Zephyr     string `yaml:"zephyr"`
+	Mattermost string `yaml:"mattermost"`
 }
 
 // Bridge encapsulates all the long-term state of the bridge.
 type Bridge struct {
-	config   Config
 	token    string
-	mu       sync.Mutex
-	lastpost map[lpkey]*model.Post
-	pmu      sync.Mutex
-	prettier *prettier.Prettier
-}
+	store    Store
+	outbox   *outbox
+	prettier *prettier.Pool
+	// reactions holds Mattermost reactions waiting to be relayed to Zephyr.
+	reactions reactions
 
-type lpkey struct {
-	class, instance string
+	// config holds the Config in effect. It is replaced, never modified, by
+	// Reload, and read without mu so that relaying messages never waits for
+	// a reload.
+	config atomic.Value
+
+	// mu serializes changes to the running bridge's routes and guards run.
+	mu sync.Mutex
+	// run is set while Run is in progress.
+	run *running
 }
 
 // New constructs a new Bridge object.
 func New(config Config, token string) (*Bridge, error) {
-	p, err := prettier.New(config.PrettierOptions)
+	p, err := prettier.NewPool(config.PrettierContexts, config.PrettierOptions, config.PrettierLimits)
 	if err != nil {
 		return nil, err
 	}
-	return &Bridge{
-		config:   config,
+	store, err := openStore(config.State)
+	if err != nil {
+		return nil, fmt.Errorf("opening state store: %w", err)
+	}
+	outbox, err := newOutbox(store)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("opening outbox: %w", err)
+	}
+	b := &Bridge{
 		token:    token,
-		lastpost: make(map[lpkey]*model.Post),
+		store:    store,
+		outbox:   outbox,
 		prettier: p,
-	}, nil
+		reactions: reactions{
+			batches: make(map[string]*reactionBatch),
+		},
+	}
+	b.config.Store(config)
+	return b, nil
+}
+
+// Close releases the resources held by the bridge.
+// It must not be called while Run is in progress.
+func (b *Bridge) Close() error {
+	return b.store.Close()
+}
+
+// currentConfig returns the configuration in effect.
+func (b *Bridge) currentConfig() Config {
+	return b.config.Load().(Config)
 }
 
 // Run the bridge until ctx is canceled.
@@ -75,7 +220,8 @@ func (b *Bridge) Run(ctx context.Context) error {
 	eg, ctx := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
-		bot, err := mm.New(b.config.Mattermost.URL, b.token)
+		mattermost := b.currentConfig().Mattermost
+		bot, err := mm.New(mattermost.URL, b.token, mattermost.teams())
 		if err != nil {
 			return err
 		}
@@ -86,21 +232,54 @@ func (b *Bridge) Run(ctx context.Context) error {
 			return ctx.Err()
 		})
 
+		posters := newPosters(ctx, eg, bot)
+
+		client, err := zephyr.NewClient()
+		if err != nil {
+			return err
+		}
+
 		personalsCh := bot.ListenPersonals()
 		eg.Go(func() error {
 			for post := range personalsCh {
+				if _, ok := post.Post.Props["from_bot"]; ok {
+					// Drop our own relayed personals
+					continue
+				}
 				if post.Post.Message == "/restart" {
 					return fmt.Errorf("restart requested by %s", post.Sender)
 				}
+				sender := strings.TrimPrefix(post.Sender, "@")
+				personal, ok := b.personalForMattermost(sender)
+				if !ok {
+					log.Printf("dropping direct message from unmapped user %q", sender)
+					continue
+				}
+				recipient, message, ok := personalRecipient(b.currentConfig().Personals, "", post.Post.Message)
+				if !ok {
+					log.Printf("dropping direct message from %q: no listed recipient in a [@user] prefix", sender)
+					continue
+				}
+				if fmt, err := b.formatMarkdown(message); err != nil {
+					log.Printf("failed to format a message: %v", err)
+				} else {
+					message = fmt
+				}
+				message += b.describeAttachments(bot, post.Post)
+				zsig := sender + " via Mattermost"
+				// The instance names the sender, so that replies come back to them.
+				if err := b.outbox.enqueue(&outgoingZephyr{
+					Instance:  personal.Zephyr,
+					Recipient: recipient.Zephyr,
+					Body:      []string{zsig, message},
+				}); err != nil {
+					log.Printf("queueing personal: %v", err)
+					return err
+				}
 			}
 			return nil
 		})
 
-		client, err := zephyr.NewClient()
-		if err != nil {
-			return err
-		}
-
 		// TODO: Remove this when zephyr-go learns how to reload its tickets.
 		expirationTime := client.TicketExpirationTime()
 		eg.Go(func() error {
@@ -118,137 +297,358 @@ func (b *Bridge) Run(ctx context.Context) error {
 			return ctx.Err()
 		})
 
-		for _, mapping := range b.config.Mappings {
-			// Make a local copy for the closure
-			mapping := mapping
-			instance := mapping.Instance
-			if instance == "" {
-				instance = "*"
+		eg.Go(func() error {
+			return b.outbox.run(ctx, client)
+		})
+
+		run := &running{
+			ctx:     ctx,
+			eg:      eg,
+			bot:     bot,
+			client:  client,
+			posters: posters,
+			subs:    make(map[z.Subscription]bool),
+		}
+		zgramCh := client.Listen()
+		eg.Go(func() error {
+			return b.dispatchZephyrs(run, zgramCh)
+		})
+		postCh := bot.ListenChannels()
+		eg.Go(func() error {
+			return b.dispatchPosts(run, postCh)
+		})
+		eg.Go(func() error {
+			return b.rescanHeaders(run)
+		})
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err := b.apply(run, b.currentConfig()); err != nil {
+			return err
+		}
+		b.run = run
+		return nil
+	})
+	err := eg.Wait()
+	b.mu.Lock()
+	b.run = nil
+	b.mu.Unlock()
+	return err
+}
+
+// relayPersonals relays personal zephyrs to the bridge as direct messages.
+func (b *Bridge) relayPersonals(run *running, zpersonalCh <-chan z.MessageReaderResult) error {
+	// directChannels caches the ID of the direct channel with each Mattermost
+	// user. It is used by the posters, so that looking a channel up doesn't
+	// hold up receiving zephyrs.
+	var mu sync.Mutex
+	directChannels := make(map[string]string)
+	lookup := func(username string) (string, error) {
+		mu.Lock()
+		channelID, ok := directChannels[username]
+		mu.Unlock()
+		if ok {
+			return channelID, nil
+		}
+		ch, err := b.directChannel(run, username)
+		if err != nil {
+			return "", err
+		}
+		mu.Lock()
+		directChannels[username] = ch.Id
+		mu.Unlock()
+		return ch.Id, nil
+	}
+	for result := range zpersonalCh {
+		message, auth := result.Message, result.AuthStatus
+		if message.Header.OpCode == "mattermost" || message.Header.OpCode == "matrix" {
+			continue
+		}
+		// zwrite pings recipients with an empty notice before sending to them.
+		if strings.EqualFold(message.Header.OpCode, "PING") {
+			continue
+		}
+		logMessage(message)
+		username := strings.TrimSuffix(message.Header.Sender, "@ATHENA.MIT.EDU")
+		if len(message.Body) < 2 {
+			log.Printf("dropping personal from %q without a message body", username)
+			continue
+		}
+		if _, ok := b.personalForZephyr(username); !ok {
+			log.Printf("dropping personal from unmapped user %q", username)
+			continue
+		}
+		recipient, text, ok := personalRecipient(b.currentConfig().Personals, message.Instance, message.Body[1])
+		if !ok {
+			log.Printf("dropping personal from %q: no listed recipient on instance %q or in a [@user] prefix", username, message.Instance)
+			continue
+		}
+		// The channel isn't known until the job runs, so personals are queued
+		// by recipient.
+		run.posters.enqueue("@"+recipient.Mattermost, postJob{
+			build: func() *model.Post {
+				channelID, err := lookup(recipient.Mattermost)
+				if err != nil {
+					log.Printf("dropping personal from %q: %v", username, err)
+					return nil
+				}
+				return &model.Post{
+					ChannelId: channelID,
+					Message:   markup.ToMarkdown(text),
+					Props: model.StringInterface{
+						"override_username": username + authMarker(auth),
+						"from_zephyr":       "true",
+						"auth":              authProp(auth),
+					},
+				}
+			},
+		})
+	}
+	return nil
+}
+
+// directChannel looks up the direct channel with a Mattermost user, retrying
+// with backoff if the lookup fails temporarily.
+func (b *Bridge) directChannel(run *running, username string) (*model.Channel, error) {
+	delay := posterMinBackoff
+	for {
+		ch, err := run.bot.GetDirectChannel(username)
+		if err == nil {
+			return ch, nil
+		}
+		if !mm.Temporary(err) || delay > posterMaxBackoff {
+			return nil, fmt.Errorf("finding direct channel with %q: %w", username, err)
+		}
+		log.Printf("finding direct channel with %q failed, retrying in %v: %v", username, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-run.ctx.Done():
+			return nil, run.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// relayZephyr queues a zephyr to be posted to Mattermost as selected by r.
+func (b *Bridge) relayZephyr(run *running, r *route, message *z.Message, auth z.AuthStatus) {
+	mapping := r.Mapping
+	instance := strings.ToLower(mapping.fixedInstance())
+	if instance == "" {
+		instance = "*"
+	}
+	// When several triplets share the channel, posts are marked with the
+	// parts of their triplet that tell them apart.
+	var showClass, showInstance bool
+	for _, other := range run.channelRoutes(r.channel.Id) {
+		if !strings.EqualFold(other.Class, mapping.Class) {
+			showClass = true
+		}
+		if !strings.EqualFold(other.fixedInstance(), mapping.fixedInstance()) {
+			showInstance = true
+		}
+	}
+	username := message.Header.Sender
+	username = strings.TrimSuffix(username, "@ATHENA.MIT.EDU")
+
+	sendChannelId := r.channel.Id
+	if altChannel, found := r.altChannels[username]; found {
+		sendChannelId = altChannel.Id
+	}
+
+	run.posters.enqueue(sendChannelId, postJob{
+		build: func() *model.Post {
+			messageText := markup.ToMarkdown(message.Body[1])
+			rootID := b.getRootID(message.Class, message.Instance, b.threadTimeout(mapping))
+
+			// Messages sent to the default instance do not need to be replies.
+			if strings.ToLower(message.Instance) == instance {
+				rootID = ""
 			}
-			zgramCh, err := client.SubscribeAndListen(mapping.Class, instance)
-			if err != nil {
-				return err
+
+			var prefix []string
+			if showClass || !strings.EqualFold(message.Class, mapping.Class) {
+				// Also mark zephyrs on variants of the mapping's class.
+				prefix = append(prefix, "-c "+message.Class)
 			}
-			// mmChannel is a Mattermost channel, NOT a Go channel.
-			mmChannel, postCh, err := bot.ListenChannel(mapping.Channel)
-			if err != nil {
-				return err
+			if rootID == "" && (instance == "*" || showInstance) && strings.ToLower(message.Instance) != "personal" {
+				prefix = append(prefix, "-i "+message.Instance)
 			}
-			if err := b.updateHeader(bot, mmChannel, mapping); err != nil {
-				return err
+			if len(prefix) > 0 {
+				messageText = fmt.Sprintf("[%s] %s", strings.Join(prefix, " "), messageText)
 			}
-			altChannels := map[string]*model.Channel{}
-			for user, channelName := range mapping.Diversions {
-				altChannel, err := bot.AttachChannel(channelName)
-				if err != nil {
-					return err
-				}
-				altChannels[user] = altChannel
+
+			return &model.Post{
+				ChannelId: sendChannelId,
+				Message:   messageText,
+				Props: model.StringInterface{
+					"override_username": username + authMarker(auth),
+					"from_zephyr":       "true",
+					"class":             message.Class,
+					"instance":          message.Instance,
+					"auth":              authProp(auth),
+				},
+				ParentId: rootID,
+				RootId:   rootID,
 			}
-			eg.Go(func() error {
-				for message := range zgramCh {
-					// Messages with opcode "matrix" come from the Matrix->Zephyr pathway,
-					// and we don't want to double-bridge them, since they are already bridged
-					// by the Matrix->Mattermost pathway
-					if message.Header.OpCode == "mattermost" || message.Header.OpCode == "matrix" {
-						continue
-					}
-					logMessage(message)
-					username := message.Header.Sender
-					username = strings.TrimSuffix(username, "@ATHENA.MIT.EDU")
-					messageText := message.Body[1]
-					rootID := b.getRootID(message.Class, message.Instance)
-
-					// TODO: The following two conditionals need to handle the case of multiple triplets mapped to a single Mattermost channel.
-
-					// Messages sent to the default instance do not need to be replies.
-					if strings.ToLower(message.Instance) == instance {
-						rootID = ""
-					}
-
-					if rootID == "" && instance == "*" && strings.ToLower(message.Instance) != "personal" {
-						messageText = fmt.Sprintf("[-i %s] %s", message.Instance, messageText)
-					}
-
-					sendChannelId := mmChannel.Id
-					if altChannel, found := altChannels[username]; found {
-						sendChannelId = altChannel.Id
-					}
-
-					post, err := bot.SendPost(&model.Post{
-						ChannelId: sendChannelId,
-						Message:   messageText,
-						Props: model.StringInterface{
-							"override_username": username,
-							"from_zephyr":       "true",
-							"class":             message.Class,
-							"instance":          message.Instance,
-						},
-						ParentId: rootID,
-						RootId:   rootID,
-					})
-					if err != nil {
-						return err
-					}
-					b.recordPost(message.Class, message.Instance, post)
-				}
-				return nil
-			})
-			eg.Go(func() error {
-				for post := range postCh {
-					logPost(mapping, post)
-					if _, ok := post.Post.Props["from_bot"]; ok {
-						// Drop any message from a bot (including ourselves)
-						continue
-					}
-					if post.Post.IsJoinLeaveMessage() {
-						// Drop join/leave messages
-						continue
-					}
-					message := post.Post.Message
-					instance := mapping.Instance
-					if instance == "" {
-						var err error
-						instance, err = b.findInstance(bot, post.Post)
-						if err != nil {
-							log.Printf("error determining instance: %v", err)
-						}
-						message = instanceRE.ReplaceAllString(message, "")
-					}
-					if instance == "" {
-						instance = "personal"
-					}
-					b.recordPost(mapping.Class, instance, post.Post)
-					if fmt, err := b.formatMarkdown(message); err != nil {
-						log.Printf("failed to format a message: %v", err)
-					} else {
-						message = fmt
-					}
-					sender := strings.TrimPrefix(post.Sender, "@")
-					zsig := bot.GetPostLink(post.Post)
-					if err := client.SendMessage(sender, mapping.Class, instance, []string{zsig, message}); err != nil {
-						log.Printf("sending message: %v", err)
-						return err
-					}
-				}
-				return nil
-			})
-		}
-		return nil
+		},
+		sent: func(post *model.Post) {
+			b.recordPost(message.Class, message.Instance, post)
+		},
 	})
-	return eg.Wait()
+}
+
+// relayPost queues a Mattermost post to be sent to Zephyr. routes are the
+// routes for the post's channel; the post's prefix or thread picks between
+// them.
+func (b *Bridge) relayPost(bot *mm.Bot, routes []*route, post mm.PostNotification) error {
+	logPost(routes[0].Mapping, post)
+	if post.Reaction != nil {
+		b.relayReaction(bot, routes, post)
+		return nil
+	}
+	if _, ok := post.Post.Props["from_bot"]; ok {
+		// Drop any message from a bot (including ourselves)
+		return nil
+	}
+	if post.Post.IsJoinLeaveMessage() {
+		// Drop join/leave messages
+		return nil
+	}
+	edited := post.Event == model.WEBSOCKET_EVENT_POST_EDITED
+	if edited && !isEdit(post.Post) {
+		// Drop updates that didn't change the message, like pinning
+		return nil
+	}
+	t, n := b.postTarget(bot, routes, post.Post)
+	r, class, instance, used, err := resolveTarget(routes, t)
+	if err != nil {
+		log.Printf("dropping post from %q: %v", post.Sender, err)
+		return nil
+	}
+	mapping := r.Mapping
+	deleted := post.Event == model.WEBSOCKET_EVENT_POST_DELETED
+	if deleted && !mapping.Retractions {
+		return nil
+	}
+	message := post.Post.Message
+	if used {
+		message = message[n:]
+	}
+	zsig := bot.GetPostLink(post.Post)
+	if deleted {
+		message = fmt.Sprintf("[deleted] The message at %s was deleted.", zsig)
+	} else {
+		if !edited {
+			b.recordPost(class, instance, post.Post)
+		}
+		if fmt, err := b.formatMessage(mapping, message); err != nil {
+			log.Printf("failed to format a message: %v", err)
+		} else {
+			message = fmt
+		}
+		if edited {
+			message = "[edited] " + message
+		}
+		message += b.describeAttachments(bot, post.Post)
+	}
+	sender := strings.TrimPrefix(post.Sender, "@")
+	if mapping.Authenticated {
+		// The zephyr comes from the bridge, so the zsig says who wrote it.
+		zsig = fmt.Sprintf("%s via %s", sender, zsig)
+	}
+	if err := b.outbox.enqueue(&outgoingZephyr{
+		Sender:        sender,
+		Class:         class,
+		Instance:      instance,
+		Authenticated: mapping.Authenticated,
+		Body:          []string{zsig, message},
+	}); err != nil {
+		log.Printf("queueing message: %v", err)
+		return err
+	}
+	return nil
+}
+
+// describeAttachments returns a plain-text list of the files attached to post,
+// suitable for appending to a zephyr body, or an empty string if there are none.
+func (b *Bridge) describeAttachments(bot *mm.Bot, post *model.Post) string {
+	if len(post.FileIds) == 0 {
+		return ""
+	}
+	infos, err := bot.GetFileInfosForPost(post.Id)
+	if err != nil {
+		log.Printf("looking up attachments for %s: %v", post.Id, err)
+		return fmt.Sprintf("\n\n[%d attachment(s): %s]", len(post.FileIds), bot.GetPostLink(post))
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\nAttachments:")
+	for _, info := range infos {
+		link, err := bot.GetFileLink(info.Id)
+		if err != nil {
+			// Public links are probably disabled; point at the post instead.
+			link = bot.GetPostLink(post)
+		}
+		fmt.Fprintf(&sb, "\n* %s (%s): %s", info.Name, formatSize(info.Size), link)
+	}
+	return sb.String()
+}
+
+// formatSize formats a file size in bytes for humans.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// personalForZephyr returns the Personal for a Zephyr username.
+func (b *Bridge) personalForZephyr(username string) (Personal, bool) {
+	for _, p := range b.currentConfig().Personals {
+		if strings.EqualFold(p.Zephyr, username) {
+			return p, true
+		}
+	}
+	return Personal{}, false
+}
+
+// personalForMattermost returns the Personal for a Mattermost username.
+func (b *Bridge) personalForMattermost(username string) (Personal, bool) {
+	for _, p := range b.currentConfig().Personals {
+		if p.Mattermost == username {
+			return p, true
+		}
+	}
+	return Personal{}, false
+}
+
+// formatMessage renders a Mattermost message for Zephyr as selected by mapping.Format.
+func (b *Bridge) formatMessage(mapping Mapping, in string) (string, error) {
+	switch mapping.Format {
+	case "", formatMarkdown:
+		return b.formatMarkdown(in)
+	case formatZephyr:
+		return markup.FromMarkdown(in), nil
+	default:
+		return "", fmt.Errorf("unknown format %q", mapping.Format)
+	}
 }
 
 func (b *Bridge) formatMarkdown(in string) (string, error) {
-	b.pmu.Lock()
-	defer b.pmu.Unlock()
-	return b.prettier.Format(in)
+	p := b.prettier.Get()
+	defer b.prettier.Put(p)
+	return p.Format(in)
 }
 
 func (b *Bridge) updateHeader(bot *mm.Bot, mmChannel *model.Channel, mapping Mapping) error {
 	// TODO: Update the header if it already has the wrong class?
 	// (Note that care needs to be taken if there are multiple mappings for a single channel.)
-	if !strings.HasPrefix(mmChannel.Header, "[-") {
+	if !mapping.fromHeader && !strings.HasPrefix(mmChannel.Header, "[-") {
 		header := fmt.Sprintf("[-c %s]", mapping.Class)
 		if mapping.Instance != "" {
 			header = fmt.Sprintf("[-c %s -i %s]", mapping.Class, mapping.Instance)
@@ -261,55 +661,202 @@ func (b *Bridge) updateHeader(bot *mm.Bot, mmChannel *model.Channel, mapping Map
 	return nil
 }
 
+// threadsBucket is the store bucket holding the most recent post for each class and instance.
+const threadsBucket = "threads"
+
+// thread records the most recent post seen on a Zephyr class and instance.
+type thread struct {
+	PostID string `json:"post_id"`
+	RootID string `json:"root_id"`
+	// CreateAt is the post's creation time, in milliseconds since the epoch.
+	CreateAt int64 `json:"create_at"`
+}
+
+func threadKey(class, instance string) string {
+	return strings.ToLower(class) + "\x00" + strings.ToLower(instance)
+}
+
 // recordPost updates the most recent post for a given class, instance.
 func (b *Bridge) recordPost(class, instance string, post *model.Post) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.lastpost[lpkey{strings.ToLower(class), strings.ToLower(instance)}] = post
+	data, err := json.Marshal(thread{
+		PostID:   post.Id,
+		RootID:   post.RootId,
+		CreateAt: post.CreateAt,
+	})
+	if err != nil {
+		log.Printf("encoding thread for [-c %s -i %s]: %v", class, instance, err)
+		return
+	}
+	if err := b.store.Put(threadsBucket, threadKey(class, instance), data); err != nil {
+		log.Printf("recording thread for [-c %s -i %s]: %v", class, instance, err)
+	}
+}
+
+// threadTimeout returns how long an instance on mapping can be idle before its thread expires.
+func (b *Bridge) threadTimeout(mapping Mapping) time.Duration {
+	if mapping.ThreadTimeout != 0 {
+		return mapping.ThreadTimeout
+	}
+	return b.currentConfig().ThreadTimeout
 }
 
 // getRootID returns the root ID that should be used for a message.
-// If there is no previous message, it returns an empty string.
-func (b *Bridge) getRootID(class, instance string) string {
-	class = strings.ToLower(class)
-	instance = strings.ToLower(instance)
-	// TODO: Store this in a stateful way?
-	// TODO: Time limit on how old the last post can be?
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	post := b.lastpost[lpkey{class, instance}]
-	if post == nil {
+// If there is no previous message, or the previous message is older than
+// timeout (when nonzero), it returns an empty string.
+func (b *Bridge) getRootID(class, instance string, timeout time.Duration) string {
+	data, err := b.store.Get(threadsBucket, threadKey(class, instance))
+	if err != nil {
+		log.Printf("looking up thread for [-c %s -i %s]: %v", class, instance, err)
 		return ""
 	}
-	if post.RootId != "" {
-		return post.RootId
+	if data == nil {
+		return ""
+	}
+	var t thread
+	if err := json.Unmarshal(data, &t); err != nil {
+		log.Printf("decoding thread for [-c %s -i %s]: %v", class, instance, err)
+		return ""
+	}
+	if timeout > 0 && time.Since(time.Unix(0, t.CreateAt*int64(time.Millisecond))) > timeout {
+		return ""
+	}
+	if t.RootID != "" {
+		return t.RootID
+	}
+	return t.PostID
+}
+
+// isEdit reports whether an edited post's message was actually changed by its latest update.
+// Mattermost also sends edit events when a post is pinned or unpinned; those bump
+// UpdateAt without touching EditAt.
+func isEdit(post *model.Post) bool {
+	return post.EditAt != 0 && post.UpdateAt-post.EditAt < 1000
+}
+
+// target is the class and instance a Mattermost post asks to be sent on.
+// Either may be empty.
+type target struct {
+	class, instance string
+}
+
+var prefixRE = regexp.MustCompile(`^\[\s*(?:-c\s+([^\s\]]+)\s*)?(?:-i\s+([^]]+?)\s*)?\]\s*`)
+
+// parsePrefix returns the target named by a "[-c class -i instance]" prefix on
+// message, either part of which may be left out, and the length of the prefix.
+// The length is zero if there is no prefix.
+func parsePrefix(message string) (target, int) {
+	matches := prefixRE.FindStringSubmatch(message)
+	if matches == nil || matches[1] == "" && matches[2] == "" {
+		return target{}, 0
+	}
+	return target{class: matches[1], instance: matches[2]}, len(matches[0])
+}
+
+// postTarget returns the target of post, and the length of its prefix, if the
+// route for it can depend on the target.
+func (b *Bridge) postTarget(bot *mm.Bot, routes []*route, post *model.Post) (target, int) {
+	if r := routes[0]; len(routes) == 1 && r.fixedInstance() != "" && !r.Variants {
+		return target{}, 0
 	}
-	return post.Id
+	t, n, err := b.findTarget(bot, post)
+	if err != nil {
+		log.Printf("error determining instance: %v", err)
+	}
+	return t, n
 }
 
-var instanceRE = regexp.MustCompile(`^\[\s*-i\s+([^]]+?)\s*\]\s*`)
+// resolveTarget returns the route, among routes for one channel, for a post
+// aimed at t, and the class and instance the post goes to. used reports
+// whether any part of t was used, in which case a prefix naming t should be
+// removed from the post. A target on a class that none of routes bridges is
+// ignored. It returns an error if the route's instance pattern
+// doesn't match the instance, since replies to it would never come back to
+// the channel.
+func resolveTarget(routes []*route, t target) (r *route, class, instance string, used bool, err error) {
+	r = pickRoute(routes, t)
+	if t.class != "" && !r.matchesClass(t.class) {
+		// None of the target applies to a class the channel doesn't bridge;
+		// its prefix is left in the post.
+		t = target{}
+	}
+	class, instance = r.Class, r.fixedInstance()
+	if t.class != "" {
+		if r.Variants {
+			class = t.class
+		}
+		used = true
+	}
+	if instance == "" && t.instance != "" {
+		instance = t.instance
+		used = true
+	}
+	if instance == "" {
+		instance = "personal"
+	}
+	if r.pattern != nil && !r.pattern.MatchString(instance) {
+		return r, class, instance, used, fmt.Errorf("instance %q is not bridged by %s", instance, r.Mapping)
+	}
+	return r, class, instance, used, nil
+}
 
-// findInstance extracts the instance that a given post should be sent on.
-func (b *Bridge) findInstance(bot *mm.Bot, post *model.Post) (string, error) {
-	if matches := instanceRE.FindStringSubmatch(post.Message); matches != nil {
-		return matches[1], nil
+// findTarget extracts the class and instance that a given post should be sent
+// on, from the post itself if it was bridged from Zephyr, from a prefix on the
+// post, or else from the thread it is in, along with the length of the prefix
+// on the post.
+func (b *Bridge) findTarget(bot *mm.Bot, post *model.Post) (target, int, error) {
+	if instance, ok := post.GetProp("instance").(string); ok {
+		// The post was bridged from Zephyr.
+		class, _ := post.GetProp("class").(string)
+		return target{class: class, instance: instance}, 0, nil
+	}
+	if t, n := parsePrefix(post.Message); n > 0 {
+		return t, n, nil
 	}
-	list, err := bot.GetPostThread(post.Id)
+	if post.RootId == "" {
+		return target{}, 0, nil
+	}
+	// Look up the thread by its root, since post itself may have been deleted.
+	list, err := bot.GetPostThread(post.RootId)
 	if err != nil {
-		return "", err
+		return target{}, 0, err
 	}
 	for i := len(list.Order) - 1; i >= 0; i-- {
 		post := list.Posts[list.Order[i]]
-		if instance := post.GetProp("instance"); instance != nil {
-			if instance, ok := instance.(string); ok {
-				return instance, nil
-			}
+		if instance, ok := post.GetProp("instance").(string); ok {
+			class, _ := post.GetProp("class").(string)
+			return target{class: class, instance: instance}, 0, nil
 		}
-		if matches := instanceRE.FindStringSubmatch(post.Message); matches != nil {
-			return matches[1], nil
+		if t, n := parsePrefix(post.Message); n > 0 {
+			return t, 0, nil
 		}
 	}
-	return "", nil
+	return target{}, 0, nil
+}
+
+// authMarker returns what is shown after the sender of a zephyr that wasn't
+// authenticated, since anyone can claim to be its sender.
+func authMarker(auth z.AuthStatus) string {
+	switch auth {
+	case z.AuthYes:
+		return ""
+	case z.AuthNo:
+		return " (unauthenticated)"
+	default:
+		return " (forged)"
+	}
+}
+
+// authProp returns the value of the "auth" property of a post bridged from a
+// zephyr: "yes", "no" or "failed".
+func authProp(auth z.AuthStatus) string {
+	switch auth {
+	case z.AuthYes:
+		return "yes"
+	case z.AuthNo:
+		return "no"
+	default:
+		return "failed"
+	}
 }
 
 // logMessage logs a Zephyr message.
@@ -0,0 +1,243 @@
+package bridge
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestResolveTarget(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		mappings []Mapping
+		target   target
+		// wantRoute is the index of the route the post goes through.
+		wantRoute               int
+		wantClass, wantInstance string
+		wantUsed, wantErr       bool
+	}{
+		{
+			name:         "fixed instance",
+			mappings:     []Mapping{{Class: "sipb", Instance: "test"}},
+			wantClass:    "sipb",
+			wantInstance: "test",
+		},
+		{
+			name:         "fixed instance ignores target",
+			mappings:     []Mapping{{Class: "sipb", Instance: "test"}},
+			target:       target{instance: "other"},
+			wantClass:    "sipb",
+			wantInstance: "test",
+		},
+		{
+			name:         "whole class",
+			mappings:     []Mapping{{Class: "sipb"}},
+			target:       target{instance: "foo"},
+			wantClass:    "sipb",
+			wantInstance: "foo",
+			wantUsed:     true,
+		},
+		{
+			name:         "whole class without instance",
+			mappings:     []Mapping{{Class: "sipb", Instance: "*"}},
+			wantClass:    "sipb",
+			wantInstance: "personal",
+		},
+		{
+			name:         "pattern",
+			mappings:     []Mapping{{Class: "sipb", Instance: "help.*"}},
+			target:       target{instance: "help.me"},
+			wantClass:    "sipb",
+			wantInstance: "help.me",
+			wantUsed:     true,
+		},
+		{
+			name:     "pattern doesn't match",
+			mappings: []Mapping{{Class: "sipb", Instance: "help.*"}},
+			target:   target{instance: "foo"},
+			wantErr:  true,
+		},
+		{
+			name:     "pattern without instance",
+			mappings: []Mapping{{Class: "sipb", Instance: "help.*"}},
+			wantErr:  true,
+		},
+		{
+			name:         "pattern matching personal",
+			mappings:     []Mapping{{Class: "sipb", Instance: `/personal|help\..*/`}},
+			wantClass:    "sipb",
+			wantInstance: "personal",
+		},
+		{
+			name:         "variant",
+			mappings:     []Mapping{{Class: "sipb", Variants: true}},
+			target:       target{class: "unsipb", instance: "x"},
+			wantClass:    "unsipb",
+			wantInstance: "x",
+			wantUsed:     true,
+		},
+		{
+			name:         "not a variant",
+			mappings:     []Mapping{{Class: "sipb", Instance: "test"}},
+			target:       target{class: "unsipb"},
+			wantClass:    "sipb",
+			wantInstance: "test",
+		},
+		{
+			name:         "other class",
+			mappings:     []Mapping{{Class: "sipb"}},
+			target:       target{class: "other", instance: "foo"},
+			wantClass:    "sipb",
+			wantInstance: "personal",
+		},
+		{
+			name:         "shared channel by class",
+			mappings:     []Mapping{{Class: "sipb", Instance: "test"}, {Class: "other"}},
+			target:       target{class: "Other", instance: "y"},
+			wantRoute:    1,
+			wantClass:    "other",
+			wantInstance: "y",
+			wantUsed:     true,
+		},
+		{
+			name:         "shared channel by instance",
+			mappings:     []Mapping{{Class: "sipb", Instance: "help.*"}, {Class: "sipb", Instance: "test.*"}},
+			target:       target{instance: "test.1"},
+			wantRoute:    1,
+			wantClass:    "sipb",
+			wantInstance: "test.1",
+			wantUsed:     true,
+		},
+		{
+			name:         "shared channel by class and instance",
+			mappings:     []Mapping{{Class: "sipb", Instance: "help"}, {Class: "sipb", Instance: "test"}},
+			target:       target{class: "sipb", instance: "test"},
+			wantRoute:    1,
+			wantClass:    "sipb",
+			wantInstance: "test",
+			wantUsed:     true,
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var routes []*route
+			for _, mapping := range c.mappings {
+				pattern, err := mapping.instancePattern()
+				if err != nil {
+					t.Fatal(err)
+				}
+				routes = append(routes, &route{Mapping: mapping, pattern: pattern})
+			}
+			r, class, instance, used, err := resolveTarget(routes, c.target)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("resolveTarget(%+v) = -c %s -i %s, want an error", c.target, class, instance)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTarget(%+v) failed: %v", c.target, err)
+			}
+			if r != routes[c.wantRoute] {
+				t.Errorf("resolveTarget(%+v) picked %s, want %s", c.target, r.Mapping, routes[c.wantRoute].Mapping)
+			}
+			if class != c.wantClass || instance != c.wantInstance || used != c.wantUsed {
+				t.Errorf("resolveTarget(%+v) = -c %s -i %s (used %v), want -c %s -i %s (used %v)", c.target, class, instance, used, c.wantClass, c.wantInstance, c.wantUsed)
+			}
+		})
+	}
+}
+
+func TestGetRootID(t *testing.T) {
+	millisAgo := func(age time.Duration) int64 {
+		return time.Now().Add(-age).UnixNano() / int64(time.Millisecond)
+	}
+	for _, c := range []struct {
+		name string
+		// post is the most recent post on the instance, if any.
+		post          *model.Post
+		globalTimeout time.Duration
+		mapping       Mapping
+		want          string
+	}{
+		{
+			name: "no previous post",
+			want: "",
+		},
+		{
+			name: "previous post starts the thread",
+			post: &model.Post{Id: "p", CreateAt: millisAgo(time.Minute)},
+			want: "p",
+		},
+		{
+			name: "previous post in a thread",
+			post: &model.Post{Id: "p", RootId: "r", CreateAt: millisAgo(time.Minute)},
+			want: "r",
+		},
+		{
+			name: "no timeout",
+			post: &model.Post{Id: "p", CreateAt: millisAgo(1000 * time.Hour)},
+			want: "p",
+		},
+		{
+			name:          "within global timeout",
+			post:          &model.Post{Id: "p", CreateAt: millisAgo(30 * time.Minute)},
+			globalTimeout: time.Hour,
+			want:          "p",
+		},
+		{
+			name:          "expired by global timeout",
+			post:          &model.Post{Id: "p", CreateAt: millisAgo(2 * time.Hour)},
+			globalTimeout: time.Hour,
+			want:          "",
+		},
+		{
+			name:          "mapping extends timeout",
+			post:          &model.Post{Id: "p", CreateAt: millisAgo(2 * time.Hour)},
+			globalTimeout: time.Hour,
+			mapping:       Mapping{ThreadTimeout: 3 * time.Hour},
+			want:          "p",
+		},
+		{
+			name:    "mapping sets timeout",
+			post:    &model.Post{Id: "p", CreateAt: millisAgo(2 * time.Hour)},
+			mapping: Mapping{ThreadTimeout: time.Hour},
+			want:    "",
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b := &Bridge{store: newMemoryStore()}
+			b.config.Store(Config{ThreadTimeout: c.globalTimeout})
+			if c.post != nil {
+				b.recordPost("SIPB", "Test", c.post)
+			}
+			if got := b.getRootID("sipb", "test", b.threadTimeout(c.mapping)); got != c.want {
+				t.Errorf("getRootID() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestThreadEncoding(t *testing.T) {
+	b := &Bridge{store: newMemoryStore()}
+	b.recordPost("sipb", "test", &model.Post{Id: "p", RootId: "r", CreateAt: 1500000000000})
+	data, err := b.store.Get(threadsBucket, threadKey("sipb", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encoding is kept in the state database across versions.
+	const want = `{"post_id":"p","root_id":"r","create_at":1500000000000}`
+	if string(data) != want {
+		t.Errorf("recorded thread = %s, want %s", data, want)
+	}
+	var got thread
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (thread{PostID: "p", RootID: "r", CreateAt: 1500000000000}) {
+		t.Errorf("decoded thread = %+v", got)
+	}
+}
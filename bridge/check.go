@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/sipb/mm2zephyr/mm"
+	"github.com/sipb/mm2zephyr/prettier"
+)
+
+// Check validates config without contacting any servers and returns the
+// problems it finds.
+func (config Config) Check() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if config.Mattermost.URL == "" {
+		add("mattermost.url is not set")
+	}
+	if err := prettier.CheckOptions(config.PrettierOptions); err != nil {
+		add("%v", err)
+	}
+	if config.PrettierContexts < 0 {
+		add("prettier_contexts must not be negative")
+	}
+	if config.ThreadTimeout < 0 {
+		add("thread_timeout must not be negative")
+	}
+	if config.HeaderMappings.Interval < 0 {
+		add("header_mappings.interval must not be negative")
+	}
+	for i, mapping := range config.Mappings {
+		where := fmt.Sprintf("mappings[%d] (%s)", i, mapping)
+		if mapping.Channel == "" {
+			add("%s: channel is empty", where)
+		}
+		if mapping.Class == "" {
+			add("%s: class is empty", where)
+		}
+		if mapping.Team != "" && !containsFold(config.Mattermost.teams(), mapping.Team) {
+			add("%s: team %q is not listed in mattermost.teams", where, mapping.Team)
+		}
+		if _, err := mapping.instancePattern(); err != nil {
+			add("%s: invalid instance pattern: %v", where, err)
+		}
+		if mapping.ThreadTimeout < 0 {
+			add("%s: thread_timeout must not be negative", where)
+		}
+		switch mapping.Format {
+		case "", formatMarkdown, formatZephyr:
+		default:
+			add("%s: unknown format %q; use %q or %q", where, mapping.Format, formatMarkdown, formatZephyr)
+		}
+		switch mapping.Direction {
+		case "", directionBoth, directionZephyrToMattermost, directionMattermostToZephyr:
+		default:
+			add("%s: unknown direction %q; use %q, %q or %q", where, mapping.Direction, directionZephyrToMattermost, directionMattermostToZephyr, directionBoth)
+		}
+		for _, user := range sortedKeys(mapping.Diversions) {
+			switch channel := mapping.Diversions[user]; channel {
+			case "":
+				add("%s: diversion for %q has no channel", where, user)
+			case mapping.Channel:
+				add("%s: diversion for %q goes to the mapping's own channel", where, user)
+			}
+		}
+		for j, earlier := range config.Mappings[:i] {
+			if earlier.shadows(mapping) {
+				add("%s: never receives zephyrs, because mappings[%d] (%s) matches them first; move it earlier or remove it", where, j, earlier)
+				break
+			}
+		}
+	}
+	zephyrUsers := make(map[string]bool)
+	mattermostUsers := make(map[string]bool)
+	for i, personal := range config.Personals {
+		where := fmt.Sprintf("personals[%d]", i)
+		if personal.Zephyr == "" || personal.Mattermost == "" {
+			add("%s: both zephyr and mattermost users must be set", where)
+			continue
+		}
+		if zephyrUsers[strings.ToLower(personal.Zephyr)] {
+			add("%s: zephyr user %q is listed more than once", where, personal.Zephyr)
+		}
+		if mattermostUsers[strings.ToLower(personal.Mattermost)] {
+			add("%s: mattermost user %q is listed more than once", where, personal.Mattermost)
+		}
+		zephyrUsers[strings.ToLower(personal.Zephyr)] = true
+		mattermostUsers[strings.ToLower(personal.Mattermost)] = true
+	}
+	// Either username names a person, so one person's names can't be another's.
+	for i, personal := range config.Personals {
+		for j, other := range config.Personals {
+			if i != j && strings.EqualFold(personal.Zephyr, other.Mattermost) {
+				add("personals[%d]: zephyr user %q is personals[%d]'s mattermost user", i, personal.Zephyr, j)
+			}
+		}
+	}
+	return errs
+}
+
+// CheckOnline checks that the channels and users named in config exist on
+// the Mattermost server, without joining any channels or sending anything.
+func (config Config) CheckOnline(token string) []error {
+	bot, err := mm.NewLookup(config.Mattermost.URL, token, config.Mattermost.teams())
+	if err != nil {
+		return []error{fmt.Errorf("connecting to mattermost: %w", err)}
+	}
+	defer bot.Close()
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	for i, mapping := range config.Mappings {
+		where := fmt.Sprintf("mappings[%d] (%s)", i, mapping)
+		if ch, err := bot.GetChannelByName(mapping.Team, mapping.Channel); err != nil {
+			add("%s: channel %q: %v", where, mapping.Channel, err)
+		} else if private := ch.Type == model.CHANNEL_PRIVATE; private && !mapping.Private {
+			add("%s: channel %q is private; set private: true to bridge it", where, mapping.Channel)
+		} else if !private && mapping.Private {
+			add("%s: channel %q is not private, but the mapping is marked private", where, mapping.Channel)
+		}
+		for _, user := range sortedKeys(mapping.Diversions) {
+			channel := mapping.Diversions[user]
+			if ch, err := bot.GetChannelByName(mapping.Team, channel); err != nil {
+				add("%s: diversion channel %q for %q: %v", where, channel, user, err)
+			} else if ch.Type != model.CHANNEL_OPEN {
+				add("%s: diversion channel %q for %q is not public", where, channel, user)
+			}
+		}
+	}
+	for i, personal := range config.Personals {
+		if _, err := bot.GetUserByUsername(personal.Mattermost); err != nil {
+			add("personals[%d]: mattermost user %q: %v", i, personal.Mattermost, err)
+		}
+	}
+	return errs
+}
+
+func (mapping Mapping) String() string {
+	channel := mapping.Channel
+	if mapping.Team != "" {
+		channel = mapping.Team + "/" + channel
+	}
+	s := fmt.Sprintf("%s: -c %s", channel, mapping.Class)
+	if mapping.Instance != "" {
+		s += " -i " + mapping.Instance
+	}
+	return s
+}
+
+// shadows reports whether every zephyr that other matches is matched by
+// mapping, so that other never sees any zephyrs if it comes later.
+// Overlapping patterns aren't detected unless they are the same.
+func (mapping Mapping) shadows(other Mapping) bool {
+	if !mapping.toMattermost() || !other.toMattermost() || !mapping.matchesClass(other.Class) {
+		return false
+	}
+	if other.Variants && !mapping.Variants {
+		// other still gets zephyrs on the variants of its class.
+		return false
+	}
+	if mapping.Instance == "" || mapping.Instance == "*" || strings.EqualFold(mapping.Instance, other.Instance) {
+		return true
+	}
+	instance := other.fixedInstance()
+	if instance == "" {
+		return false
+	}
+	pattern, err := mapping.instancePattern()
+	return err == nil && pattern != nil && pattern.MatchString(instance)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,29 @@
+package bridge
+
+import "testing"
+
+func TestShadows(t *testing.T) {
+	for _, c := range []struct {
+		earlier, later Mapping
+		want           bool
+	}{
+		{Mapping{Class: "sipb"}, Mapping{Class: "sipb", Instance: "test"}, true},
+		{Mapping{Class: "sipb", Instance: "*"}, Mapping{Class: "SIPB"}, true},
+		{Mapping{Class: "sipb", Instance: "test"}, Mapping{Class: "sipb"}, false},
+		{Mapping{Class: "sipb", Instance: "test"}, Mapping{Class: "sipb", Instance: "TEST"}, true},
+		{Mapping{Class: "sipb"}, Mapping{Class: "other"}, false},
+		{Mapping{Class: "sipb", Instance: "help.*"}, Mapping{Class: "sipb", Instance: "help.me"}, true},
+		{Mapping{Class: "sipb", Instance: "help.*"}, Mapping{Class: "sipb", Instance: "test"}, false},
+		{Mapping{Class: "sipb", Instance: "help.*"}, Mapping{Class: "sipb", Instance: "help.m?"}, false},
+		{Mapping{Class: "sipb", Variants: true}, Mapping{Class: "unsipb"}, true},
+		{Mapping{Class: "sipb", Variants: true}, Mapping{Class: "sipb", Variants: true}, true},
+		{Mapping{Class: "sipb"}, Mapping{Class: "unsipb"}, false},
+		{Mapping{Class: "sipb"}, Mapping{Class: "sipb", Variants: true}, false},
+		{Mapping{Class: "sipb", Direction: directionMattermostToZephyr}, Mapping{Class: "sipb"}, false},
+		{Mapping{Class: "sipb"}, Mapping{Class: "sipb", Direction: directionMattermostToZephyr}, false},
+	} {
+		if got := c.earlier.shadows(c.later); got != c.want {
+			t.Errorf("(%s, variants %v).shadows(%s, variants %v) = %v, want %v", c.earlier, c.earlier.Variants, c.later, c.later.Variants, got, c.want)
+		}
+	}
+}
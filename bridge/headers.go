@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sipb/mm2zephyr/mm"
+)
+
+// HeaderMappingsConfig represents the configuration for bridging channels
+// according to their headers.
+type HeaderMappingsConfig struct {
+	// Enabled bridges every public channel whose header starts with a
+	// "[zephyr -c class]" or "[zephyr -c class -i instance]" prefix, so that
+	// channel admins can bridge a channel without editing the configuration.
+	// The "zephyr" marker tells these apart from the "[-c class -i instance]"
+	// prefixes written for mapped channels, which stay behind when a mapping
+	// is removed. Mappings take precedence: channels and triplets they name or
+	// cover aren't bridged by header.
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often channel headers are scanned for changes, besides
+	// when the bridge starts and is reloaded. Defaults to 5 minutes.
+	Interval time.Duration `yaml:"interval"`
+}
+
+const defaultHeaderScanInterval = 5 * time.Minute
+
+// headerPrefixRE matches the marker at the start of a channel header that
+// asks for the channel to be bridged.
+var headerPrefixRE = regexp.MustCompile(`^\[\s*zephyr\s+`)
+
+// parseHeader returns the target named by a "[zephyr -c class -i instance]"
+// prefix on a channel header, and whether there is one with a class.
+func parseHeader(header string) (target, bool) {
+	loc := headerPrefixRE.FindStringIndex(header)
+	if loc == nil {
+		return target{}, false
+	}
+	t, n := parsePrefix("[" + header[loc[1]:])
+	if n == 0 || t.class == "" {
+		return target{}, false
+	}
+	return t, true
+}
+
+// headerMappings returns a mapping for each public channel on teams with a
+// bridging header.
+func headerMappings(bot *mm.Bot, teams []string) ([]Mapping, error) {
+	var mappings []Mapping
+	for _, team := range teams {
+		channels, err := bot.GetPublicChannels(team)
+		if err != nil {
+			return nil, fmt.Errorf("team %q: %w", team, err)
+		}
+		for _, ch := range channels {
+			t, ok := parseHeader(ch.Header)
+			if !ok {
+				continue
+			}
+			mappings = append(mappings, Mapping{
+				Channel:    ch.Name,
+				Team:       team,
+				Class:      t.class,
+				Instance:   t.instance,
+				fromHeader: true,
+			})
+		}
+	}
+	return mappings, nil
+}
+
+// mergeHeaderMappings adds the mappings from channel headers after those from
+// the configuration, which take precedence. A header mapping is dropped if its
+// channel or triplet is already mapped, or if a configured mapping shadows it.
+// Among header mappings, one goes just before the first that would shadow it,
+// so that instances can be peeled off a class that is mapped as a whole.
+// Mappings without a team are on defaultTeam.
+func mergeHeaderMappings(mappings, headers []Mapping, defaultTeam string) []Mapping {
+	merged := append([]Mapping(nil), mappings...)
+	for _, header := range headers {
+		if conflicts(mappings, header, defaultTeam) {
+			continue
+		}
+		i := len(merged)
+		for j := len(mappings); j < len(merged); j++ {
+			if merged[j].shadows(header) {
+				i = j
+				break
+			}
+		}
+		merged = append(merged[:i], append([]Mapping{header}, merged[i:]...)...)
+	}
+	return merged
+}
+
+// conflicts reports whether mapping's channel or triplet is already in
+// mappings, or one of mappings shadows it.
+func conflicts(mappings []Mapping, mapping Mapping, defaultTeam string) bool {
+	team := func(m Mapping) string {
+		if m.Team == "" {
+			return defaultTeam
+		}
+		return m.Team
+	}
+	for _, m := range mappings {
+		if m.Channel == mapping.Channel && strings.EqualFold(team(m), team(mapping)) {
+			return true
+		}
+		if strings.EqualFold(m.Class, mapping.Class) && strings.EqualFold(m.Instance, mapping.Instance) {
+			return true
+		}
+		if m.shadows(mapping) {
+			return true
+		}
+	}
+	return false
+}
+
+// rescanHeaders periodically reapplies the configuration to run, to pick up
+// changes to channel headers.
+func (b *Bridge) rescanHeaders(run *running) error {
+	for {
+		interval := b.currentConfig().HeaderMappings.Interval
+		if interval <= 0 {
+			interval = defaultHeaderScanInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-run.ctx.Done():
+			return nil
+		}
+		b.mu.Lock()
+		if config := b.currentConfig(); b.run == run && config.HeaderMappings.Enabled {
+			if err := b.apply(run, config); err != nil {
+				log.Printf("applying channel header mappings: %v", err)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeHeaderMappings(t *testing.T) {
+	for _, c := range []struct {
+		name              string
+		mappings, headers []Mapping
+		// want lists the channels of the merged mappings, in order.
+		want []string
+	}{
+		{
+			name:     "after configuration",
+			mappings: []Mapping{{Channel: "sipb", Class: "sipb"}},
+			headers:  []Mapping{{Channel: "other", Class: "other"}},
+			want:     []string{"sipb", "other"},
+		},
+		{
+			name:     "same channel",
+			mappings: []Mapping{{Channel: "sipb", Class: "sipb"}},
+			headers:  []Mapping{{Channel: "sipb", Class: "other"}},
+			want:     []string{"sipb"},
+		},
+		{
+			name:     "same triplet",
+			mappings: []Mapping{{Channel: "sipb", Class: "sipb", Instance: "help"}},
+			headers:  []Mapping{{Channel: "help", Class: "SIPB", Instance: "HELP"}},
+			want:     []string{"sipb"},
+		},
+		{
+			name:     "shadowed by configuration",
+			mappings: []Mapping{{Channel: "sipb", Class: "sipb"}},
+			headers:  []Mapping{{Channel: "random", Class: "sipb", Instance: "help"}},
+			want:     []string{"sipb"},
+		},
+		{
+			name:     "shadowing configuration",
+			mappings: []Mapping{{Channel: "help", Class: "sipb", Instance: "help"}},
+			headers:  []Mapping{{Channel: "sipb", Class: "sipb"}},
+			want:     []string{"help", "sipb"},
+		},
+		{
+			name:    "peeled off another header",
+			headers: []Mapping{{Channel: "sipb", Class: "sipb"}, {Channel: "help", Class: "sipb", Instance: "help"}},
+			want:    []string{"help", "sipb"},
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, mapping := range mergeHeaderMappings(c.mappings, c.headers, "sipb") {
+				got = append(got, mapping.Channel)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("mergeHeaderMappings() gave channels %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   target
+		wantOK bool
+	}{
+		{"[zephyr -c sipb] SIPB", target{class: "sipb"}, true},
+		{"[zephyr -c sipb -i help me]", target{class: "sipb", instance: "help me"}, true},
+		{"[ zephyr  -c sipb]", target{class: "sipb"}, true},
+		{"[zephyr -i help]", target{}, false},
+		// Prefixes written for configured mappings don't ask to be bridged.
+		{"[-c sipb -i help] SIPB", target{}, false},
+		{"[-c sipb]", target{}, false},
+		{"Talk about [zephyr -c sipb]", target{}, false},
+		{"", target{}, false},
+	} {
+		got, ok := parseHeader(c.header)
+		if got != c.want || ok != c.wantOK {
+			t.Errorf("parseHeader(%q) = %+v, %v, want %+v, %v", c.header, got, ok, c.want, c.wantOK)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sipb/mm2zephyr/zephyr"
+)
+
+const (
+	// outboxBucket holds zephyrs waiting to be sent, keyed by sequence number.
+	outboxBucket = "outbox"
+	// deadLetterBucket holds zephyrs that could not be sent after outboxMaxAttempts tries.
+	deadLetterBucket = "outbox-dead"
+
+	outboxMaxAttempts = 10
+	outboxMinBackoff  = time.Second
+	outboxMaxBackoff  = 5 * time.Minute
+	// outboxMaxFailure is how long every send can keep failing before the
+	// bridge gives up on its Zephyr session and restarts.
+	outboxMaxFailure = 10 * time.Minute
+)
+
+// outgoingZephyr is a zephyr waiting in the outbox.
+type outgoingZephyr struct {
+	Sender   string `json:"sender,omitempty"`
+	Class    string `json:"class,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Recipient is set for personal zephyrs, which are sent from the bridge's
+	// own principal. Their Instance defaults to "PERSONAL".
+	Recipient string `json:"recipient,omitempty"`
+	// Authenticated zephyrs are sent from the bridge's own principal rather
+	// than claiming to be from Sender.
+	Authenticated bool     `json:"authenticated,omitempty"`
+	Body          []string `json:"body"`
+	Attempts      int      `json:"attempts,omitempty"`
+	LastError     string   `json:"last_error,omitempty"`
+	// NextAttempt is when a zephyr that failed to send is due to be retried.
+	NextAttempt time.Time `json:"next_attempt"`
+	// FailingSince is when the zephyr first failed to send.
+	FailingSince time.Time `json:"failing_since,omitempty"`
+}
+
+func (z *outgoingZephyr) send(client *zephyr.Client) error {
+	if z.Recipient != "" {
+		return client.SendPersonal(z.Recipient, z.Instance, z.Body)
+	}
+	if z.Authenticated {
+		return client.SendAuthenticatedMessage(z.Class, z.Instance, z.Body)
+	}
+	return client.SendMessage(z.Sender, z.Class, z.Instance, z.Body)
+}
+
+// destination identifies where z is sent, so that zephyrs to the same place
+// are kept in order.
+func (z *outgoingZephyr) destination() string {
+	if z.Recipient != "" {
+		return "personal\x00" + strings.ToLower(z.Recipient)
+	}
+	return threadKey(z.Class, z.Instance)
+}
+
+func (z *outgoingZephyr) String() string {
+	if z.Recipient != "" {
+		return fmt.Sprintf("personal to %s", z.Recipient)
+	}
+	return fmt.Sprintf("[-c %s -i %s] from %s", z.Class, z.Instance, z.Sender)
+}
+
+// outbox is a persistent FIFO queue of zephyrs to send. Zephyrs that fail to
+// send are retried with exponential backoff, so that a transient Zephyr outage
+// delays messages instead of dropping them. Ones that keep failing are moved
+// to a dead-letter bucket, but only once another zephyr has been sent since
+// they started failing, so that a longer outage doesn't drop them either.
+// While a zephyr waits to be retried, those behind it for the same class and
+// instance, or the same recipient, wait too, but the rest of the queue is
+// sent.
+type outbox struct {
+	store  Store
+	notify chan struct{}
+
+	mu  sync.Mutex
+	seq uint64
+
+	// lastSent is when a zephyr was last sent successfully. It is only used by run.
+	lastSent time.Time
+}
+
+func newOutbox(store Store) (*outbox, error) {
+	o := &outbox{
+		store:  store,
+		notify: make(chan struct{}, 1),
+	}
+	// Continue numbering after anything left over from a previous run,
+	// including dead letters, which keep their keys.
+	for _, bucket := range []string{outboxBucket, deadLetterBucket} {
+		err := store.ForEach(bucket, func(key string, value []byte) error {
+			seq, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s key %q: %w", bucket, key, err)
+			}
+			if seq > o.seq {
+				o.seq = seq
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// enqueue adds z to the end of the queue.
+func (o *outbox) enqueue(z *outgoingZephyr) error {
+	data, err := json.Marshal(z)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.seq++
+	err = o.store.Put(outboxBucket, formatOutboxKey(o.seq), data)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// formatOutboxKey returns the key for the zephyr with sequence number seq,
+// zero-padded so that the store's key order is queue order.
+func formatOutboxKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// next returns the first zephyr in the queue that is due to be sent. Zephyrs
+// waiting to be retried are skipped, along with any queued behind them for the
+// same destination. If no zephyr is due, next returns how long it is until
+// one will be, or zero if the queue is empty.
+func (o *outbox) next(now time.Time) (string, *outgoingZephyr, time.Duration, error) {
+	var key string
+	var next *outgoingZephyr
+	var wait time.Duration
+	waiting := make(map[string]bool)
+	err := o.store.ForEach(outboxBucket, func(k string, value []byte) error {
+		z := new(outgoingZephyr)
+		if err := json.Unmarshal(value, z); err != nil {
+			return fmt.Errorf("decoding outbox entry %s: %w", k, err)
+		}
+		if waiting[z.destination()] {
+			return nil
+		}
+		if d := z.NextAttempt.Sub(now); d > 0 {
+			waiting[z.destination()] = true
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			return nil
+		}
+		key, next = k, z
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return "", nil, 0, err
+	}
+	return key, next, wait, nil
+}
+
+// errFound stops a ForEach once the entry sought is found.
+var errFound = errors.New("found")
+
+func (o *outbox) put(bucket, key string, z *outgoingZephyr) error {
+	data, err := json.Marshal(z)
+	if err != nil {
+		return err
+	}
+	return o.store.Put(bucket, key, data)
+}
+
+// run sends queued zephyrs with client, in order for each destination, until
+// ctx is canceled. It returns an error if every send has been failing for
+// outboxMaxFailure, so that the bridge reconnects to Zephyr.
+func (o *outbox) run(ctx context.Context, client *zephyr.Client) error {
+	// failingSince is when sends started failing, or zero if they aren't.
+	var failingSince time.Time
+	for {
+		key, z, wait, err := o.next(time.Now())
+		if err != nil {
+			return err
+		}
+		if z == nil {
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-o.notify:
+			case <-retry:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		err = z.send(client)
+		now := time.Now()
+		if err == nil {
+			o.lastSent, failingSince = now, time.Time{}
+			if err := o.store.Delete(outboxBucket, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if failingSince.IsZero() {
+			failingSince = now
+		} else if now.Sub(failingSince) > outboxMaxFailure {
+			return fmt.Errorf("sending zephyrs failing since %v: %w", failingSince.Format(time.RFC3339), err)
+		}
+		z.Attempts++
+		z.LastError = err.Error()
+		if z.FailingSince.IsZero() {
+			z.FailingSince = now
+		}
+		if z.Attempts >= outboxMaxAttempts && o.lastSent.After(z.FailingSince) {
+			log.Printf("giving up on zephyr %s after %d attempts: %s", z, z.Attempts, z.LastError)
+			if err := o.put(deadLetterBucket, key, z); err != nil {
+				return err
+			}
+			if err := o.store.Delete(outboxBucket, key); err != nil {
+				return err
+			}
+			continue
+		}
+		delay := outboxMinBackoff << (z.Attempts - 1)
+		if delay > outboxMaxBackoff || delay <= 0 {
+			delay = outboxMaxBackoff
+		}
+		z.NextAttempt = now.Add(delay)
+		if err := o.put(outboxBucket, key, z); err != nil {
+			return err
+		}
+		log.Printf("sending zephyr %s failed (attempt %d), retrying in %v: %s", z, z.Attempts, delay, z.LastError)
+	}
+}
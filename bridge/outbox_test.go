@@ -0,0 +1,136 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxNext(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := func(d time.Duration) time.Time { return now.Add(d) }
+	for _, c := range []struct {
+		name   string
+		queued []outgoingZephyr
+		// want is the index of the zephyr next returns, or -1 if none is due.
+		want     int
+		wantWait time.Duration
+	}{
+		{
+			name: "empty",
+			want: -1,
+		},
+		{
+			name: "first in order",
+			queued: []outgoingZephyr{
+				{Class: "sipb", Instance: "a"},
+				{Class: "sipb", Instance: "b"},
+			},
+			want: 0,
+		},
+		{
+			name: "retry due",
+			queued: []outgoingZephyr{
+				{Class: "sipb", Instance: "a", NextAttempt: later(-time.Second)},
+			},
+			want: 0,
+		},
+		{
+			name: "waiting blocks the same destination",
+			queued: []outgoingZephyr{
+				{Class: "sipb", Instance: "a", NextAttempt: later(time.Minute)},
+				{Class: "SIPB", Instance: "A"},
+			},
+			want:     -1,
+			wantWait: time.Minute,
+		},
+		{
+			name: "waiting doesn't block other destinations",
+			queued: []outgoingZephyr{
+				{Class: "sipb", Instance: "a", NextAttempt: later(time.Minute)},
+				{Class: "sipb", Instance: "a"},
+				{Class: "sipb", Instance: "b"},
+			},
+			want:     2,
+			wantWait: time.Minute,
+		},
+		{
+			name: "personals by recipient",
+			queued: []outgoingZephyr{
+				{Recipient: "quentin", NextAttempt: later(time.Minute)},
+				{Recipient: "Quentin"},
+				{Recipient: "alice"},
+			},
+			want:     2,
+			wantWait: time.Minute,
+		},
+		{
+			name: "shortest wait",
+			queued: []outgoingZephyr{
+				{Class: "sipb", Instance: "a", NextAttempt: later(time.Minute)},
+				{Class: "sipb", Instance: "b", NextAttempt: later(time.Second)},
+				{Class: "sipb", Instance: "b", NextAttempt: later(-time.Second)},
+			},
+			want:     -1,
+			wantWait: time.Second,
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			o, err := newOutbox(newMemoryStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for i := range c.queued {
+				if err := o.enqueue(&c.queued[i]); err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, formatOutboxKey(o.seq))
+			}
+			key, z, wait, err := o.next(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.want < 0 {
+				if z != nil {
+					t.Errorf("next() = %s, want none", z)
+				}
+			} else if z == nil || key != keys[c.want] {
+				t.Errorf("next() = %q (%v), want %q (%s)", key, z, keys[c.want], &c.queued[c.want])
+			}
+			if wait != c.wantWait {
+				t.Errorf("next() waits %v, want %v", wait, c.wantWait)
+			}
+		})
+	}
+}
+
+func TestOutboxKeepsDeadLetters(t *testing.T) {
+	store := newMemoryStore()
+	o, err := newOutbox(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.enqueue(&outgoingZephyr{Class: "sipb"}); err != nil {
+		t.Fatal(err)
+	}
+	key := formatOutboxKey(o.seq)
+	if err := store.Put(deadLetterBucket, key, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(outboxBucket, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart with an empty outbox must not reuse the dead letter's key.
+	o, err = newOutbox(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.enqueue(&outgoingZephyr{Class: "sipb"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := formatOutboxKey(o.seq); got == key {
+		t.Errorf("enqueue after restart reused dead letter key %q", key)
+	}
+}
@@ -0,0 +1,56 @@
+package bridge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// isRegexpPattern reports whether instance is a regular expression, written
+// between slashes.
+func isRegexpPattern(instance string) bool {
+	return len(instance) >= 2 && strings.HasPrefix(instance, "/") && strings.HasSuffix(instance, "/")
+}
+
+// fixedInstance returns the single instance the mapping bridges, or "" if it
+// bridges every instance on its class, or those matching a pattern.
+func (mapping Mapping) fixedInstance() string {
+	instance := mapping.Instance
+	if strings.ContainsAny(instance, "*?") || isRegexpPattern(instance) {
+		return ""
+	}
+	return instance
+}
+
+// instancePattern compiles the mapping's instance pattern into a regular
+// expression matching whole instances, ignoring case. It returns nil if the
+// mapping's instance is not a pattern, or is empty or the plain "*" wildcard.
+func (mapping Mapping) instancePattern() (*regexp.Regexp, error) {
+	instance := mapping.Instance
+	var expr string
+	switch {
+	case instance == "" || instance == "*" || mapping.fixedInstance() != "":
+		return nil, nil
+	case isRegexpPattern(instance):
+		expr = instance[1 : len(instance)-1]
+	default:
+		expr = globExpr(instance)
+	}
+	return regexp.Compile(`(?i)^(?:` + expr + `)$`)
+}
+
+// globExpr translates a glob, in which * matches any run of characters and ?
+// matches any one character, into a regular expression.
+func globExpr(glob string) string {
+	var sb strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,89 @@
+package bridge
+
+import "testing"
+
+func TestGlobExpr(t *testing.T) {
+	for _, c := range []struct {
+		glob, want string
+	}{
+		{"", ""},
+		{"help", "help"},
+		{"help.*", `help\..*`},
+		{"h?lp", "h.lp"},
+		{"[x]+", `\[x\]\+`},
+		{"*.d.*", `.*\.d\..*`},
+	} {
+		if got := globExpr(c.glob); got != c.want {
+			t.Errorf("globExpr(%q) = %q, want %q", c.glob, got, c.want)
+		}
+	}
+}
+
+func TestInstancePattern(t *testing.T) {
+	for _, c := range []struct {
+		instance string
+		// nilPattern is set if the instance isn't a pattern.
+		nilPattern bool
+		wantErr    bool
+		match      []string
+		noMatch    []string
+	}{
+		{instance: "", nilPattern: true},
+		{instance: "*", nilPattern: true},
+		{instance: "help", nilPattern: true},
+		{
+			instance: "help.*",
+			match:    []string{"help.", "help.me", "HELP.Me", "help.a.b"},
+			noMatch:  []string{"help", "xhelp.me", "helpme"},
+		},
+		{
+			instance: "h?lp",
+			match:    []string{"help", "halp", "H.LP"},
+			noMatch:  []string{"hlp", "heelp", "help.me"},
+		},
+		{
+			instance: `/help(\..*)?/`,
+			match:    []string{"help", "help.me", "Help.Me"},
+			noMatch:  []string{"helpme", "xhelp", "help me"},
+		},
+		{
+			instance: "/a|b/",
+			match:    []string{"a", "b"},
+			noMatch:  []string{"ab", "xa", "bx"},
+		},
+		{instance: "/(/", wantErr: true},
+	} {
+		c := c
+		t.Run(c.instance, func(t *testing.T) {
+			pattern, err := Mapping{Class: "sipb", Instance: c.instance}.instancePattern()
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("instancePattern() = %v, want an error", pattern)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("instancePattern() failed: %v", err)
+			}
+			if c.nilPattern {
+				if pattern != nil {
+					t.Fatalf("instancePattern() = %v, want nil", pattern)
+				}
+				return
+			}
+			if pattern == nil {
+				t.Fatal("instancePattern() = nil")
+			}
+			for _, instance := range c.match {
+				if !pattern.MatchString(instance) {
+					t.Errorf("%v doesn't match %q", pattern, instance)
+				}
+			}
+			for _, instance := range c.noMatch {
+				if pattern.MatchString(instance) {
+					t.Errorf("%v matches %q", pattern, instance)
+				}
+			}
+		})
+	}
+}
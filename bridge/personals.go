@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// recipientRE matches a "[@user]" prefix naming the recipient of a personal.
+var recipientRE = regexp.MustCompile(`^\[\s*@([^\s\]]+)\s*\]\s*`)
+
+// findPersonal returns the person named by name, which may be either their
+// Zephyr or their Mattermost username.
+func findPersonal(personals []Personal, name string) (Personal, bool) {
+	for _, p := range personals {
+		if strings.EqualFold(p.Zephyr, name) || strings.EqualFold(p.Mattermost, name) {
+			return p, true
+		}
+	}
+	return Personal{}, false
+}
+
+// personalRecipient returns the person a personal is addressed to, and
+// message without any prefix naming them. The recipient is named by
+// instance, unless it is empty or "personal", or else by a "[@user]" prefix
+// on message. ok is false if no listed person is named.
+func personalRecipient(personals []Personal, instance, message string) (recipient Personal, rest string, ok bool) {
+	name := instance
+	if name == "" || strings.EqualFold(name, "personal") {
+		matches := recipientRE.FindStringSubmatch(message)
+		if matches == nil {
+			return Personal{}, message, false
+		}
+		name, message = matches[1], message[len(matches[0]):]
+	}
+	recipient, ok = findPersonal(personals, name)
+	return recipient, message, ok
+}
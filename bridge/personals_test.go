@@ -0,0 +1,32 @@
+package bridge
+
+import "testing"
+
+func TestPersonalRecipient(t *testing.T) {
+	personals := []Personal{
+		{Zephyr: "alice", Mattermost: "alice.smith"},
+		{Zephyr: "bob", Mattermost: "bob"},
+	}
+	for _, c := range []struct {
+		name              string
+		instance, message string
+		// want is the Zephyr username of the recipient, or empty if there is none.
+		want, wantRest string
+	}{
+		{"instance", "bob", "hi", "bob", "hi"},
+		{"instance names mattermost user", "Alice.Smith", "hi", "alice", "hi"},
+		{"instance wins over prefix", "bob", "[@alice] hi", "bob", "[@alice] hi"},
+		{"prefix on personal instance", "PERSONAL", "[@alice] hi", "alice", "hi"},
+		{"prefix without instance", "", "[ @alice.smith ]hi", "alice", "hi"},
+		{"no recipient", "personal", "hi", "", "hi"},
+		{"no recipient in direct message", "", "hi", "", "hi"},
+		{"unlisted instance", "carol", "hi", "", "hi"},
+		{"unlisted prefix", "", "[@carol] hi", "", "hi"},
+		{"prefix later in message", "", "hi [@bob]", "", "hi [@bob]"},
+	} {
+		got, rest, ok := personalRecipient(personals, c.instance, c.message)
+		if ok != (c.want != "") || got.Zephyr != c.want || rest != c.wantRest {
+			t.Errorf("%s: personalRecipient(%q, %q) = %+v, %q, %v, want %q, %q", c.name, c.instance, c.message, got, rest, ok, c.want, c.wantRest)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/sipb/mm2zephyr/mm"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// posterQueueSize is the number of posts that can wait for each channel
+	// before the oldest are dropped.
+	posterQueueSize  = 100
+	posterMinBackoff = time.Second
+	posterMaxBackoff = time.Minute
+	// posterMaxFailure is how long posting to a channel can keep failing
+	// before the bridge gives up and restarts.
+	posterMaxFailure = 10 * time.Minute
+)
+
+// postJob is a post waiting to be sent to Mattermost.
+type postJob struct {
+	// build constructs the post when it is about to be sent, so that it can
+	// be threaded onto posts that were queued ahead of it. It returns nil if
+	// the post should be dropped.
+	build func() *model.Post
+	// sent, if not nil, is called with the created post.
+	sent func(*model.Post)
+}
+
+// posters sends posts to Mattermost through a bounded queue per channel,
+// retrying failed posts with backoff so that a rate limit or a brief outage
+// doesn't restart the bridge.
+type posters struct {
+	ctx context.Context
+	eg  *errgroup.Group
+	bot *mm.Bot
+
+	mu     sync.Mutex
+	queues map[string]chan postJob
+}
+
+func newPosters(ctx context.Context, eg *errgroup.Group, bot *mm.Bot) *posters {
+	return &posters{
+		ctx:    ctx,
+		eg:     eg,
+		bot:    bot,
+		queues: make(map[string]chan postJob),
+	}
+}
+
+// enqueue adds job to the queue for channelID, dropping the oldest queued
+// post if the queue is full. Jobs that find their channel when they are built
+// can be queued under another key.
+func (p *posters) enqueue(channelID string, job postJob) {
+	p.mu.Lock()
+	q, ok := p.queues[channelID]
+	if !ok {
+		q = make(chan postJob, posterQueueSize)
+		p.queues[channelID] = q
+		p.eg.Go(func() error {
+			return p.run(channelID, q)
+		})
+	}
+	p.mu.Unlock()
+	for {
+		select {
+		case q <- job:
+			return
+		default:
+		}
+		select {
+		case <-q:
+			log.Printf("queue for channel %s is full; dropping its oldest post", channelID)
+		default:
+		}
+	}
+}
+
+// run sends the posts queued for channelID until the context is canceled.
+func (p *posters) run(channelID string, q <-chan postJob) error {
+	// failingSince is when posting to this channel started failing, or zero if it isn't.
+	var failingSince time.Time
+	for {
+		select {
+		case job := <-q:
+			if err := p.send(job, &failingSince); err != nil {
+				return fmt.Errorf("posting to channel %s: %w", channelID, err)
+			}
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+	}
+}
+
+func (p *posters) send(job postJob, failingSince *time.Time) error {
+	post := job.build()
+	if post == nil {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		created, err := p.bot.SendPost(post)
+		if err == nil {
+			*failingSince = time.Time{}
+			if job.sent != nil {
+				job.sent(created)
+			}
+			return nil
+		}
+		var perr *mm.PostError
+		if errors.As(err, &perr) && !perr.Temporary() {
+			if post.RootId != "" {
+				// The thread may have been deleted; try starting a new one.
+				log.Printf("%s failed, retrying outside its thread: %v", describePost(post), err)
+				post.RootId, post.ParentId = "", ""
+				continue
+			}
+			// Retrying won't help.
+			log.Printf("dropping %s: %v", describePost(post), err)
+			return nil
+		}
+		if failingSince.IsZero() {
+			*failingSince = time.Now()
+		} else if time.Since(*failingSince) > posterMaxFailure {
+			return fmt.Errorf("failing since %v: %w", failingSince.Format(time.RFC3339), err)
+		}
+		delay := posterMinBackoff << (attempt - 1)
+		if delay > posterMaxBackoff || delay <= 0 {
+			delay = posterMaxBackoff
+		}
+		if perr != nil && perr.RetryAfter > 0 {
+			delay = perr.RetryAfter
+		}
+		log.Printf("%s failed (attempt %d), retrying in %v: %v", describePost(post), attempt, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+	}
+}
+
+// describePost names a post being sent, for logging.
+func describePost(post *model.Post) string {
+	class, _ := post.GetProp("class").(string)
+	instance, _ := post.GetProp("instance").(string)
+	if class == "" {
+		return fmt.Sprintf("post to channel %s", post.ChannelId)
+	}
+	return fmt.Sprintf("post for [-c %s -i %s]", class, instance)
+}
@@ -0,0 +1,160 @@
+package bridge
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/sipb/mm2zephyr/mm"
+)
+
+const (
+	// reactionDelay is how long reactions on an instance are collected before
+	// they are relayed, so that a burst of reactions becomes a single zephyr
+	// and each instance gets at most one zephyr about reactions in that time.
+	reactionDelay = 30 * time.Second
+	// maxReactionLines is how many lines of reactions are described in one zephyr.
+	maxReactionLines = 10
+)
+
+// reactions holds the reactions waiting to be relayed, by class and instance.
+type reactions struct {
+	mu      sync.Mutex
+	batches map[string]*reactionBatch
+}
+
+// reactionBatch collects the reactions to posts on a class and instance.
+type reactionBatch struct {
+	class, instance string
+	authenticated   bool
+	// reactors are the users who reacted and the posts they reacted to, in
+	// the order they first did.
+	reactors []reactor
+	// counts is, for each reactor and emoji, how many times the reaction was
+	// added less how many times it was removed.
+	counts map[reactor]map[string]int
+}
+
+// reactor is a user reacting to a post.
+type reactor struct {
+	user string
+	// link is the permalink of the post.
+	link string
+}
+
+// relayReaction records a reaction to be relayed to Zephyr, if the mapping of
+// the post reacted to relays reactions.
+func (b *Bridge) relayReaction(bot *mm.Bot, routes []*route, post mm.PostNotification) {
+	relayed := false
+	for _, r := range routes {
+		relayed = relayed || r.Reactions
+	}
+	if !relayed {
+		// Don't bother looking up the post.
+		return
+	}
+	if err := bot.LookUpReaction(&post); err != nil {
+		log.Printf("dropping reaction: %v", err)
+		return
+	}
+	t, _ := b.postTarget(bot, routes, post.Post)
+	r, class, instance, _, err := resolveTarget(routes, t)
+	if err != nil || !r.Reactions {
+		return
+	}
+	who := reactor{
+		user: strings.TrimPrefix(post.Sender, "@"),
+		link: bot.GetPostLink(post.Post),
+	}
+	count := 1
+	if post.Event == model.WEBSOCKET_EVENT_REACTION_REMOVED {
+		count = -1
+	}
+
+	key := threadKey(class, instance)
+	b.reactions.mu.Lock()
+	defer b.reactions.mu.Unlock()
+	batch, ok := b.reactions.batches[key]
+	if !ok {
+		batch = &reactionBatch{
+			class:         class,
+			instance:      instance,
+			authenticated: r.Authenticated,
+			counts:        make(map[reactor]map[string]int),
+		}
+		b.reactions.batches[key] = batch
+		time.AfterFunc(reactionDelay, func() {
+			b.flushReactions(key)
+		})
+	}
+	if batch.counts[who] == nil {
+		batch.reactors = append(batch.reactors, who)
+		batch.counts[who] = make(map[string]int)
+	}
+	batch.counts[who][post.Reaction.EmojiName] += count
+}
+
+// flushReactions sends a zephyr describing the reactions collected for a
+// class and instance.
+func (b *Bridge) flushReactions(key string) {
+	b.reactions.mu.Lock()
+	batch := b.reactions.batches[key]
+	delete(b.reactions.batches, key)
+	b.reactions.mu.Unlock()
+
+	lines := batch.describe()
+	if len(lines) == 0 {
+		// Everything added was removed again.
+		return
+	}
+	// Zephyrs about a single user's reactions come from them.
+	sender := batch.reactors[0].user
+	for _, who := range batch.reactors {
+		if who.user != sender {
+			sender = "mattermost"
+			break
+		}
+	}
+	if len(lines) > maxReactionLines {
+		lines = append(lines[:maxReactionLines], fmt.Sprintf("and %d more", len(lines)-maxReactionLines))
+	}
+	if err := b.outbox.enqueue(&outgoingZephyr{
+		Sender:        sender,
+		Class:         batch.class,
+		Instance:      batch.instance,
+		Authenticated: batch.authenticated,
+		Body:          []string{"reactions via Mattermost", strings.Join(lines, "\n")},
+	}); err != nil {
+		log.Printf("queueing reactions: %v", err)
+	}
+}
+
+// describe returns a line for each user and post whose reactions changed,
+// like "alice reacted :+1: :tada: to <link>".
+func (batch *reactionBatch) describe() []string {
+	var lines []string
+	for _, who := range batch.reactors {
+		var added, removed []string
+		for emoji, count := range batch.counts[who] {
+			switch {
+			case count > 0:
+				added = append(added, ":"+emoji+":")
+			case count < 0:
+				removed = append(removed, ":"+emoji+":")
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		if len(added) > 0 {
+			lines = append(lines, fmt.Sprintf("%s reacted %s to %s", who.user, strings.Join(added, " "), who.link))
+		}
+		if len(removed) > 0 {
+			lines = append(lines, fmt.Sprintf("%s removed %s from %s", who.user, strings.Join(removed, " "), who.link))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,416 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/sipb/mm2zephyr/mm"
+	"github.com/sipb/mm2zephyr/zephyr"
+	z "github.com/zephyr-im/zephyr-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// running holds the connections of the bridge while Run is in progress.
+type running struct {
+	ctx     context.Context
+	eg      *errgroup.Group
+	bot     *mm.Bot
+	client  *zephyr.Client
+	posters *posters
+
+	// The following are only touched by apply, with Bridge.mu held.
+
+	// personals is set once the client has subscribed to personals.
+	personals bool
+	// subs is the set of zephyr subscriptions that have been made.
+	subs map[z.Subscription]bool
+
+	mu sync.Mutex
+	// routes are the mappings being bridged, in the order they are matched.
+	routes []*route
+}
+
+// route is a mapping that is being bridged.
+type route struct {
+	Mapping
+	// pattern matches the instances the mapping bridges, if its instance is a pattern.
+	pattern *regexp.Regexp
+	// channel is a Mattermost channel, NOT a Go channel.
+	channel     *model.Channel
+	altChannels map[string]*model.Channel
+	// posts carries posts in channel to the goroutine relaying them to Zephyr.
+	posts chan mm.PostNotification
+	// done is closed when the mapping is removed.
+	done chan struct{}
+}
+
+// subscriptions returns the zephyr subscriptions that receive the mapping's
+// zephyrs, if it bridges them.
+// Mappings with instance patterns are subscribed to the whole class, and the
+// bridge picks out the matching zephyrs.
+func (mapping Mapping) subscriptions() []z.Subscription {
+	if !mapping.toMattermost() {
+		return nil
+	}
+	instance := mapping.fixedInstance()
+	if instance == "" {
+		instance = "*"
+	}
+	classes := []string{mapping.Class}
+	if mapping.Variants {
+		classes = variantClasses(mapping.Class)
+	}
+	var subs []z.Subscription
+	for _, class := range classes {
+		subs = append(subs, z.Subscription{
+			Class:    strings.ToLower(class),
+			Instance: strings.ToLower(instance),
+		})
+	}
+	return subs
+}
+
+// matches reports whether a zephyr on class and instance belongs to the route.
+func (r *route) matches(class, instance string) bool {
+	if !r.matchesClass(class) {
+		return false
+	}
+	if r.pattern != nil {
+		return r.pattern.MatchString(instance)
+	}
+	fixed := r.fixedInstance()
+	return fixed == "" || strings.EqualFold(fixed, instance)
+}
+
+// routeZephyr returns the first route that bridges message, or nil.
+func (run *running) routeZephyr(message *z.Message) *route {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	for _, r := range run.routes {
+		if r.toMattermost() && r.matches(message.Class, message.Instance) {
+			return r
+		}
+	}
+	return nil
+}
+
+// channelRoutes returns the routes for a Mattermost channel, in order.
+func (run *running) channelRoutes(channelID string) []*route {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	var routes []*route
+	for _, r := range run.routes {
+		if r.channel.Id == channelID {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// postRoutes returns the routes that bridge the channel post was made in to
+// Zephyr, in order.
+func (run *running) postRoutes(post mm.PostNotification) []*route {
+	var routes []*route
+	for _, r := range run.channelRoutes(post.Post.ChannelId) {
+		if r.toZephyr() {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// pickRoute returns the route, among those sharing a channel, for a post aimed at t.
+// Without a class to go on, the first route that bridges the instance on its
+// own class is used, or else the first route.
+func pickRoute(routes []*route, t target) *route {
+	if t.class == "" && t.instance != "" {
+		for _, r := range routes {
+			if r.matches(r.Class, t.instance) {
+				return r
+			}
+		}
+	}
+	if t.class != "" {
+		if t.instance != "" {
+			for _, r := range routes {
+				if r.matches(t.class, t.instance) {
+					return r
+				}
+			}
+		}
+		for _, r := range routes {
+			if r.matchesClass(t.class) {
+				return r
+			}
+		}
+	}
+	return routes[0]
+}
+
+// dispatchZephyrs relays each zephyr received by the client to Mattermost.
+func (b *Bridge) dispatchZephyrs(run *running, zgramCh <-chan z.MessageReaderResult) error {
+	for result := range zgramCh {
+		message := result.Message
+		// Messages with opcode "matrix" come from the Matrix->Zephyr pathway,
+		// and we don't want to double-bridge them, since they are already bridged
+		// by the Matrix->Mattermost pathway
+		if message.Header.OpCode == "mattermost" || message.Header.OpCode == "matrix" {
+			continue
+		}
+		logMessage(message)
+		r := run.routeZephyr(message)
+		if r == nil {
+			log.Printf("no mapping for [-c %s -i %s]", message.Class, message.Instance)
+			continue
+		}
+		if r.RequireAuth && result.AuthStatus != z.AuthYes {
+			log.Printf("dropping zephyr from %s: %v", message.Header.Sender, result.AuthStatus)
+			continue
+		}
+		b.relayZephyr(run, r, message, result.AuthStatus)
+	}
+	return nil
+}
+
+// dispatchPosts hands each post in a mapped channel to the goroutine of the
+// channel's first route.
+func (b *Bridge) dispatchPosts(run *running, postCh <-chan mm.PostNotification) error {
+	for post := range postCh {
+		routes := run.postRoutes(post)
+		if len(routes) == 0 {
+			log.Printf("unhandled post from %q: %#v", post.Sender, post.Post)
+			continue
+		}
+		// The first route for the channel relays posts for all of them.
+		r := routes[0]
+		select {
+		case r.posts <- post:
+		case <-r.done:
+		case <-run.ctx.Done():
+		}
+	}
+	return nil
+}
+
+// relayPosts relays the posts dispatched to r to Zephyr until r is removed.
+func (b *Bridge) relayPosts(run *running, r *route) error {
+	for {
+		select {
+		case post := <-r.posts:
+			routes := run.postRoutes(post)
+			if len(routes) == 0 {
+				// The channel's mappings were removed since the post was dispatched.
+				continue
+			}
+			if err := b.relayPost(run.bot, routes, post); err != nil {
+				return err
+			}
+		case <-r.done:
+			return nil
+		case <-run.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// newRoute prepares the Mattermost side of mapping.
+func (b *Bridge) newRoute(bot *mm.Bot, mapping Mapping) (*route, error) {
+	pattern, err := mapping.instancePattern()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapping, err)
+	}
+	attach := bot.AttachChannel
+	if mapping.Private {
+		attach = bot.AttachPrivateChannel
+	}
+	mmChannel, err := attach(mapping.Team, mapping.Channel)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.updateHeader(bot, mmChannel, mapping); err != nil {
+		return nil, err
+	}
+	altChannels := map[string]*model.Channel{}
+	for user, channelName := range mapping.Diversions {
+		altChannel, err := bot.AttachChannel(mapping.Team, channelName)
+		if err != nil {
+			return nil, err
+		}
+		altChannels[user] = altChannel
+	}
+	return &route{
+		Mapping:     mapping,
+		pattern:     pattern,
+		channel:     mmChannel,
+		altChannels: altChannels,
+		posts:       make(chan mm.PostNotification),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// apply makes the running bridge bridge the mappings in config, along with
+// those from channel headers if they are enabled.
+// Routes for mappings that haven't changed are kept as they are; new ones are
+// set up before any old ones are removed, so on error nothing has changed
+// except that some subscriptions may have been added.
+// b.mu must be held. Since apply waits on Mattermost and Zephyr, nothing that
+// relays messages may take b.mu.
+func (b *Bridge) apply(run *running, config Config) error {
+	run.mu.Lock()
+	old := run.routes
+	run.mu.Unlock()
+
+	mappings := config.Mappings
+	if config.HeaderMappings.Enabled {
+		teams := config.Mattermost.teams()
+		headers, err := headerMappings(run.bot, teams)
+		if err != nil {
+			return fmt.Errorf("reading channel headers: %w", err)
+		}
+		mappings = mergeHeaderMappings(mappings, headers, teams[0])
+	}
+
+	kept := make(map[*route]bool)
+	var routes, added []*route
+	for _, mapping := range mappings {
+		r := findRoute(old, mapping, kept)
+		if r == nil {
+			var err error
+			r, err = b.newRoute(run.bot, mapping)
+			if err != nil && mapping.fromHeader {
+				// Don't let one channel's header stop the rest of the bridge.
+				log.Printf("skipping mapping %s from channel header: %v", mapping, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			added = append(added, r)
+		}
+		kept[r] = true
+		routes = append(routes, r)
+	}
+
+	wanted := make(map[z.Subscription]bool)
+	for _, r := range routes {
+		for _, sub := range r.subscriptions() {
+			if !run.subs[sub] {
+				if err := run.client.Subscribe(sub.Class, sub.Instance); err != nil {
+					return err
+				}
+				run.subs[sub] = true
+			}
+			wanted[sub] = true
+		}
+	}
+	if len(config.Personals) > 0 && !run.personals {
+		zpersonalCh, err := run.client.ListenPersonals()
+		if err != nil {
+			return err
+		}
+		run.personals = true
+		run.eg.Go(func() error {
+			return b.relayPersonals(run, zpersonalCh)
+		})
+	}
+
+	for _, r := range added {
+		r := r
+		if !r.toZephyr() {
+			continue
+		}
+		run.eg.Go(func() error {
+			return b.relayPosts(run, r)
+		})
+	}
+	run.mu.Lock()
+	run.routes = routes
+	run.mu.Unlock()
+	for _, r := range old {
+		if !kept[r] {
+			log.Printf("removed mapping %s", r.Mapping)
+			close(r.done)
+		}
+	}
+	for _, r := range added {
+		if old != nil {
+			log.Printf("added mapping %s", r.Mapping)
+		}
+	}
+	for sub := range run.subs {
+		if wanted[sub] {
+			continue
+		}
+		if err := run.client.Unsubscribe(sub.Class, sub.Instance); err != nil {
+			// Leave it in subs so the next reload tries again.
+			log.Printf("unsubscribing from (%q, %q): %v", sub.Class, sub.Instance, err)
+			continue
+		}
+		delete(run.subs, sub)
+	}
+	return nil
+}
+
+// findRoute returns the route in routes for mapping, skipping those already used.
+func findRoute(routes []*route, mapping Mapping, used map[*route]bool) *route {
+	for _, r := range routes {
+		if !used[r] && reflect.DeepEqual(r.Mapping, mapping) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Reload switches the bridge to config. If the bridge is running, mappings
+// that were added or changed are set up and those that were removed are torn
+// down, without reconnecting to Zephyr or Mattermost. If that fails, the
+// previous configuration stays in effect.
+// Changes to the Mattermost, state and prettier settings only take effect
+// when the program is restarted.
+func (b *Bridge) Reload(config Config) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := b.currentConfig()
+	for _, setting := range restartSettings(old, config) {
+		log.Printf("%s changed; restart the bridge to apply it", setting)
+	}
+	config.Mattermost = old.Mattermost
+	config.State = old.State
+	config.PrettierOptions = old.PrettierOptions
+	config.PrettierContexts = old.PrettierContexts
+	config.PrettierLimits = old.PrettierLimits
+	if b.run != nil && b.run.ctx.Err() == nil {
+		if err := b.apply(b.run, config); err != nil {
+			return err
+		}
+	}
+	b.config.Store(config)
+	return nil
+}
+
+// restartSettings returns the settings that differ between old and new and
+// can't be changed by Reload.
+func restartSettings(old, new Config) []string {
+	var changed []string
+	for _, s := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"mattermost", old.Mattermost, new.Mattermost},
+		{"state", old.State, new.State},
+		{"prettier", old.PrettierOptions, new.PrettierOptions},
+		{"prettier_contexts", old.PrettierContexts, new.PrettierContexts},
+		{"prettier_limits", old.PrettierLimits, new.PrettierLimits},
+	} {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,167 @@
+package bridge
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateConfig represents the configuration for persisting bridge state.
+type StateConfig struct {
+	// Path is the location of the on-disk state database.
+	// If empty, state is only kept in memory and is lost when the bridge exits.
+	Path string `yaml:"path"`
+}
+
+// Store is a key/value store used to keep bridge state across restarts.
+// Keys are grouped into buckets; a missing key is not an error.
+type Store interface {
+	// Get returns the value stored for key in bucket, or nil if there is none.
+	Get(bucket, key string) ([]byte, error)
+	// Put stores value for key in bucket, replacing any previous value.
+	Put(bucket, key string, value []byte) error
+	// Delete removes key from bucket, if present.
+	Delete(bucket, key string) error
+	// ForEach calls fn for each key in bucket, in sorted order.
+	// value is only valid during the call, and fn must not modify the store.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+// openStore opens the store described by config.
+func openStore(config StateConfig) (Store, error) {
+	if config.Path == "" {
+		return newMemoryStore(), nil
+	}
+	return openBoltStore(config.Path)
+}
+
+// memoryStore is a Store that lives only as long as the process.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Get(bucket, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *memoryStore) Put(bucket, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	if b == nil {
+		b = make(map[string][]byte)
+		s.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *memoryStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, b[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// boltStore is a Store backed by an embedded bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// Fail quickly instead of hanging if another bridge has the file open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			// v is only valid for the life of the transaction.
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,42 @@
+package bridge
+
+import "strings"
+
+// maxVariantDepth is how many "un" prefixes, and separately how many ".d"
+// suffixes, a variant class subscribed to by a mapping can have.
+const maxVariantDepth = 2
+
+// variantClasses returns class and the variants of it that are subscribed to
+// for a mapping with Variants set: "sipb", "sipb.d", "sipb.d.d", "unsipb",
+// "unsipb.d" and so on.
+func variantClasses(class string) []string {
+	var classes []string
+	for un := 0; un <= maxVariantDepth; un++ {
+		for d := 0; d <= maxVariantDepth; d++ {
+			classes = append(classes, strings.Repeat("un", un)+class+strings.Repeat(".d", d))
+		}
+	}
+	return classes
+}
+
+// isClassVariant reports whether class is base with any number of "un"
+// prefixes and ".d" suffixes, ignoring case. A class is a variant of itself.
+func isClassVariant(class, base string) bool {
+	class, base = strings.ToLower(class), strings.ToLower(base)
+	for class != base && strings.HasSuffix(class, ".d") {
+		class = strings.TrimSuffix(class, ".d")
+	}
+	for class != base && strings.HasPrefix(class, "un") {
+		class = strings.TrimPrefix(class, "un")
+	}
+	return class == base
+}
+
+// matchesClass reports whether zephyrs on class belong to the mapping, if
+// their instance does.
+func (mapping Mapping) matchesClass(class string) bool {
+	if mapping.Variants {
+		return isClassVariant(class, mapping.Class)
+	}
+	return strings.EqualFold(mapping.Class, class)
+}
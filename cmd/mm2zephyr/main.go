@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -21,8 +22,22 @@ var (
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [check-config [-online]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		checkConfig(flag.Args()[1:])
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -39,13 +54,17 @@ func main() {
 		cancel()
 	}()
 
-	data, err := ioutil.ReadFile(*configFile)
+	config, err := readConfig(*configFile, false)
 	if err != nil {
 		log.Fatal(err)
 	}
-	var config bridge.Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		log.Fatalf("unable to parse config: %v", err)
+	// Refuse to start with a configuration that reload would reject, rather
+	// than failing in Run over and over.
+	if errs := config.Check(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s: %v", *configFile, err)
+		}
+		log.Fatalf("%d problem(s) in configuration", len(errs))
 	}
 	token := os.Getenv("MM_AUTH_TOKEN")
 	b, err := bridge.New(config, token)
@@ -53,6 +72,15 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Reload the mappings on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(b)
+		}
+	}()
+
 	for ctx.Err() == nil {
 		start := time.Now()
 		err := b.Run(ctx)
@@ -61,4 +89,72 @@ func main() {
 			time.Sleep(time.Second)
 		}
 	}
+	if err := b.Close(); err != nil {
+		log.Printf("closing bridge: %v", err)
+	}
+}
+
+// reload re-reads the configuration file and applies it to b. A configuration
+// with problems is rejected, leaving the previous one in effect.
+func reload(b *bridge.Bridge) {
+	config, err := readConfig(*configFile, false)
+	if err == nil {
+		if errs := config.Check(); len(errs) > 0 {
+			for _, err := range errs {
+				log.Printf("%s: %v", *configFile, err)
+			}
+			err = fmt.Errorf("%d problem(s) in configuration", len(errs))
+		}
+	}
+	if err == nil {
+		err = b.Reload(config)
+	}
+	if err != nil {
+		log.Printf("not reloading %s: %v", *configFile, err)
+		return
+	}
+	log.Printf("reloaded %s", *configFile)
+}
+
+// readConfig reads the bridge configuration from path. If strict is set,
+// unknown and duplicate keys are errors.
+func readConfig(path string, strict bool) (bridge.Config, error) {
+	var config bridge.Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	unmarshal := yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+	if err := unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("unable to parse config: %w", err)
+	}
+	return config, nil
+}
+
+// checkConfig implements the check-config subcommand, which reports
+// problems with the configuration file and exits non-zero if there are any.
+func checkConfig(args []string) {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	online := flags.Bool("online", false, "Also check channels and users against Mattermost, using MM_AUTH_TOKEN")
+	flags.Parse(args)
+
+	config, err := readConfig(*configFile, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		os.Exit(1)
+	}
+	errs := config.Check()
+	if *online {
+		errs = append(errs, config.CheckOnline(os.Getenv("MM_AUTH_TOKEN"))...)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", *configFile)
 }
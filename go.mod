@@ -5,11 +5,13 @@ go 1.16
 require (
 	github.com/mattermost/mattermost-server/v5 v5.31.0
 	github.com/robertkrimen/otto v0.0.0-20200922221731-ef014fd054ac // indirect
+	github.com/yuin/goldmark v1.4.12
 	github.com/zephyr-im/hesiod-go v0.0.0-20180420044332-8af8fe53336a // indirect
 	github.com/zephyr-im/krb5-go v0.0.0-20180420044318-760eaf8d0a04
 	github.com/zephyr-im/zephyr-go v0.0.0-20180416034431-932a267a41af
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 	gopkg.in/yaml.v2 v2.4.0
-	rogchap.com/v8go v0.5.1 // indirect
+	rogchap.com/v8go v0.5.1
 )
@@ -0,0 +1,251 @@
+package markup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+var markdown = goldmark.New()
+
+// FromMarkdown converts Mattermost Markdown into a zephyr body using Zephyr's
+// scribe-style markup. Strong emphasis becomes @b{...}, emphasis becomes
+// @i{...}, headings are bolded, and links are replaced by numbered footnotes
+// listed at the end of the message. Literal text that a Zephyr client would
+// mistake for markup is escaped.
+func FromMarkdown(in string) string {
+	r := &zephyrRenderer{source: []byte(in)}
+	doc := markdown.Parser().Parse(text.NewReader(r.source))
+	out := r.blocks(doc, false)
+	if len(r.links) > 0 {
+		out += "\n"
+		for i, link := range r.links {
+			out += fmt.Sprintf("\n[%d] %s", i+1, escapeMarkup(link))
+		}
+	}
+	return out
+}
+
+// zephyrRenderer renders a Markdown syntax tree as Zephyr markup.
+type zephyrRenderer struct {
+	source []byte
+	// links holds the destinations of the footnotes referenced so far.
+	links []string
+}
+
+// blocks renders the block children of n, separated by blank lines unless tight.
+func (r *zephyrRenderer) blocks(n ast.Node, tight bool) string {
+	var parts []string
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		parts = append(parts, r.block(c))
+	}
+	if tight {
+		return strings.Join(parts, "\n")
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (r *zephyrRenderer) block(n ast.Node) string {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return r.inlines(n)
+	case *ast.Heading:
+		return env("b", r.inlines(n))
+	case *ast.ThematicBreak:
+		return "----"
+	case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock:
+		return escapeMarkup(strings.TrimSuffix(r.lines(n), "\n"))
+	case *ast.Blockquote:
+		lines := strings.Split(r.blocks(n, false), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return strings.Join(lines, "\n")
+	case *ast.List:
+		var items []string
+		number := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			marker := "* "
+			if n.IsOrdered() {
+				marker = fmt.Sprintf("%d%c ", number, n.Marker)
+				number++
+			}
+			body := r.blocks(item, n.IsTight)
+			indent := "\n" + strings.Repeat(" ", len(marker))
+			items = append(items, marker+strings.ReplaceAll(body, "\n", indent))
+		}
+		if n.IsTight {
+			return strings.Join(items, "\n")
+		}
+		return strings.Join(items, "\n\n")
+	default:
+		return r.blocks(n, false)
+	}
+}
+
+// lines returns the raw source lines of a block.
+func (r *zephyrRenderer) lines(n ast.Node) string {
+	var sb strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		sb.Write(line.Value(r.source))
+	}
+	return sb.String()
+}
+
+// inlines renders the inline children of n.
+func (r *zephyrRenderer) inlines(n ast.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		sb.WriteString(r.inline(c))
+	}
+	return sb.String()
+}
+
+func (r *zephyrRenderer) inline(n ast.Node) string {
+	switch n := n.(type) {
+	case *ast.Text:
+		value := n.Segment.Value(r.source)
+		if !n.IsRaw() {
+			value = util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(value)))
+		}
+		s := escapeMarkup(string(value))
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			s += "\n"
+		}
+		return s
+	case *ast.String:
+		return escapeMarkup(string(n.Value))
+	case *ast.CodeSpan:
+		return "`" + escapeMarkup(string(n.Text(r.source))) + "`"
+	case *ast.Emphasis:
+		if n.Level >= 2 {
+			return env("b", r.inlines(n))
+		}
+		return env("i", r.inlines(n))
+	case *ast.Link:
+		return r.footnote(r.inlines(n), string(n.Destination))
+	case *ast.Image:
+		return r.footnote(r.inlines(n), string(n.Destination))
+	case *ast.AutoLink:
+		return escapeMarkup(string(n.URL(r.source)))
+	case *ast.RawHTML:
+		var sb strings.Builder
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			sb.Write(segment.Value(r.source))
+		}
+		return escapeMarkup(sb.String())
+	default:
+		return r.inlines(n)
+	}
+}
+
+// footnote renders link text followed by a reference to a footnote for destination.
+// Links whose text is just the destination are left inline.
+func (r *zephyrRenderer) footnote(label, destination string) string {
+	if label == "" || label == escapeMarkup(destination) || "mailto:"+label == escapeMarkup(destination) {
+		return escapeMarkup(destination)
+	}
+	for i, link := range r.links {
+		if link == destination {
+			return fmt.Sprintf("%s[%d]", label, i+1)
+		}
+	}
+	r.links = append(r.links, destination)
+	return fmt.Sprintf("%s[%d]", label, len(r.links))
+}
+
+// env wraps s in the named Zephyr environment, choosing a delimiter whose
+// closer doesn't occur in s outside the environments nested in it, so the
+// environment isn't closed early. If s has all four closers, each stray '}'
+// is put in an @(...) grouping of its own and braces are used.
+func env(name, s string) string {
+	if s == "" {
+		return ""
+	}
+	stray := strayClosers(s)
+	for _, open := range []byte("{([<") {
+		if closer := closers[open]; !containsByte(stray, s, closer) {
+			return "@" + name + string(open) + s + string(closer)
+		}
+	}
+	var sb strings.Builder
+	last := 0
+	for _, i := range stray {
+		if s[i] == '}' {
+			sb.WriteString(s[last:i])
+			sb.WriteString("@(})")
+			last = i + 1
+		}
+	}
+	sb.WriteString(s[last:])
+	return "@" + name + "{" + sb.String() + "}"
+}
+
+// strayClosers returns the indexes of the closing delimiters in s that aren't
+// inside an environment, parsing s like parse does.
+func strayClosers(s string) []int {
+	var stray []int
+	// open holds the closers of the environments the scan is inside.
+	var open []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '@' {
+			if i+1 < len(s) && s[i+1] == '@' {
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(s) && isNameByte(s[j]) {
+				j++
+			}
+			if j < len(s) {
+				if end, ok := closers[s[j]]; ok {
+					open = append(open, end)
+					i = j
+				}
+			}
+			continue
+		}
+		if len(open) > 0 {
+			if c == open[len(open)-1] {
+				open = open[:len(open)-1]
+			}
+			continue
+		}
+		if strings.IndexByte("})]>", c) >= 0 {
+			stray = append(stray, i)
+		}
+	}
+	return stray
+}
+
+// containsByte reports whether s has c at any of the indexes.
+func containsByte(indexes []int, s string, c byte) bool {
+	for _, i := range indexes {
+		if s[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// markupRE matches a run of '@'s that a Zephyr client would take as markup:
+// one that starts an environment, or any "@@", which stands for a literal '@'.
+var markupRE = regexp.MustCompile(`@+[A-Za-z0-9_]*[{(\[<]|@@+`)
+
+// escapeMarkup escapes literal text that would otherwise be interpreted as
+// Zephyr markup, by doubling each '@' in a run that is markup.
+func escapeMarkup(s string) string {
+	return markupRE.ReplaceAllStringFunc(s, func(m string) string {
+		at := len(m) - len(strings.TrimLeft(m, "@"))
+		return m[:at] + m
+	})
+}
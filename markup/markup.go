@@ -0,0 +1,185 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A node is a piece of parsed Zephyr markup: either literal text or an
+// environment such as @b{...} wrapping further nodes.
+type node struct {
+	text string
+	// env is the lowercased environment name, or "" for text nodes and
+	// for bare @(...) groupings.
+	env      string
+	isEnv    bool
+	children []node
+}
+
+// closers maps each environment opening delimiter to its closing delimiter.
+var closers = map[byte]byte{
+	'{': '}',
+	'(': ')',
+	'[': ']',
+	'<': '>',
+}
+
+// parse parses Zephyr markup in s starting at i until the closer delimiter
+// (or the end of s, if closer is 0). It returns the parsed nodes and the
+// index just past the closer.
+// Like zwgc, an '@' that doesn't start a well-formed environment is literal,
+// and environments left unclosed run to the end of the message.
+func parse(s string, i int, closer byte) ([]node, int) {
+	var nodes []node
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, node{text: text.String()})
+			text.Reset()
+		}
+	}
+	for i < len(s) {
+		c := s[i]
+		if closer != 0 && c == closer {
+			flush()
+			return nodes, i + 1
+		}
+		if c != '@' {
+			text.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '@' {
+			text.WriteByte('@')
+			i += 2
+			continue
+		}
+		j := i + 1
+		for j < len(s) && isNameByte(s[j]) {
+			j++
+		}
+		if j >= len(s) {
+			text.WriteByte('@')
+			i++
+			continue
+		}
+		end, ok := closers[s[j]]
+		if !ok {
+			text.WriteByte('@')
+			i++
+			continue
+		}
+		flush()
+		children, next := parse(s, j+1, end)
+		nodes = append(nodes, node{
+			env:      strings.ToLower(s[i+1 : j]),
+			isEnv:    true,
+			children: children,
+		})
+		i = next
+	}
+	flush()
+	return nodes, i
+}
+
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// ToMarkdown converts a zephyr body containing Zephyr's scribe-style markup
+// (@b{...}, @i{...}, @color(...), and so on) into Mattermost Markdown.
+// Bold and italic environments become Markdown emphasis, formatting with no
+// Markdown equivalent (colors, fonts, alignment, sizes) is dropped, and
+// characters that Markdown would otherwise interpret are escaped.
+func ToMarkdown(in string) string {
+	nodes, _ := parse(in, 0, 0)
+	var sb strings.Builder
+	renderMarkdown(&sb, nodes, false, false)
+	return escapeLineStarts(sb.String())
+}
+
+// renderMarkdown renders nodes as Markdown. bold and italic report whether
+// the nodes are already inside emphasis of that kind, which isn't repeated
+// since Markdown can't nest it.
+func renderMarkdown(sb *strings.Builder, nodes []node, bold, italic bool) {
+	for _, n := range nodes {
+		if !n.isEnv {
+			sb.WriteString(escapeText(n.text))
+			continue
+		}
+		switch {
+		case (n.env == "b" || n.env == "bold") && !bold:
+			var inner strings.Builder
+			renderMarkdown(&inner, n.children, true, italic)
+			sb.WriteString(emphasize(inner.String(), "**"))
+		case (n.env == "i" || n.env == "italic") && !italic:
+			var inner strings.Builder
+			renderMarkdown(&inner, n.children, bold, true)
+			sb.WriteString(emphasize(inner.String(), "*"))
+		case n.env == "color" || n.env == "font":
+			// These take an argument rather than text, and have no Markdown equivalent.
+		default:
+			renderMarkdown(sb, n.children, bold, italic)
+		}
+	}
+}
+
+// emphasize wraps each line of s in delim. Markdown doesn't allow emphasis to
+// start or end with whitespace or span paragraphs, so surrounding whitespace
+// is kept outside the delimiters and lines are wrapped individually.
+func emphasize(s, delim string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		start := strings.Index(line, trimmed)
+		lines[i] = line[:start] + delim + trimmed + delim + line[start+len(trimmed):]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// urlRE matches URLs, which are left unescaped so that Mattermost still links them.
+var urlRE = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>]+`)
+
+var inlineEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"`", "\\`",
+	"~", `\~`,
+	"[", `\[`,
+	"]", `\]`,
+	"|", `\|`,
+)
+
+// escapeText escapes characters in literal text that Markdown would treat as inline formatting.
+func escapeText(s string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range urlRE.FindAllStringIndex(s, -1) {
+		sb.WriteString(inlineEscaper.Replace(s[last:loc[0]]))
+		sb.WriteString(s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(inlineEscaper.Replace(s[last:]))
+	return sb.String()
+}
+
+// blockRE matches the start of a line that Markdown would treat as a heading,
+// block quote, list item, horizontal rule, or setext underline.
+var blockRE = regexp.MustCompile(`(?m)^([ \t]*)([#>+=-]|[0-9]+[.)])`)
+
+// escapeLineStarts escapes block-level Markdown syntax at the start of lines.
+func escapeLineStarts(s string) string {
+	return blockRE.ReplaceAllStringFunc(s, func(m string) string {
+		sub := blockRE.FindStringSubmatch(m)
+		indent, marker := sub[1], sub[2]
+		if n := len(marker); n > 1 {
+			// Ordered list item; escape the punctuation after the number.
+			return indent + marker[:n-1] + `\` + marker[n-1:]
+		}
+		return indent + `\` + marker
+	})
+}
@@ -0,0 +1,108 @@
+package markup
+
+import "testing"
+
+func TestToMarkdown(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"plain", "plain text", "plain text"},
+		{"bold", "@b{bold}", "**bold**"},
+		{"italic", "@i(it)", "*it*"},
+		{"long names and delimiters", "@bold[x] @italic<y>", "**x** *y*"},
+		{"bare grouping", "@(a @b{b} c)", "a **b** c"},
+		{"nested", "@b{a @i(b @b[c]) d}", "**a *b c* d**"},
+		{"nested groupings", "@(a @(b @i{c}) d)", "a b *c* d"},
+		{"bold italic", "@b{@i{x}}", "***x***"},
+		{"unclosed", "@b{unclosed", "**unclosed**"},
+		{"unclosed nested", "@i(a @b{b", "*a **b***"},
+		{"other closers inside", "@b{a)b]c>d}", "**a)b\\]c>d**"},
+		{"stray closers", "a}b)c", "a}b)c"},
+		{"escaped at", "a@@b", "a@b"},
+		{"escaped environment", "@@b{x}", "@b{x}"},
+		{"email address", "mail user@mit.edu", "mail user@mit.edu"},
+		{"unknown environment", "foo@bar{baz}", "foobaz"},
+		{"lone at", "@", "@"},
+		{"trailing at", "x@", "x@"},
+		{"name without delimiter", "@b", "@b"},
+		{"color", "@color(red)hi", "hi"},
+		{"font", "@font(fixed)@b{x}", "**x**"},
+		{"center", "@center(x)", "x"},
+		{"multiline emphasis", "@b{line1\nline2}", "**line1**\n**line2**"},
+		{"padded emphasis", "@b{ padded }", " **padded** "},
+		{"empty emphasis", "a@b{}b", "ab"},
+		{"inline syntax", "a_b *c* `d` ~e~ [f] g|h \\", "a\\_b \\*c\\* \\`d\\` \\~e\\~ \\[f\\] g\\|h \\\\"},
+		{"url with underscores", "see http://example.com/a_b_c", "see http://example.com/a_b_c"},
+		{"url and text", "x_y https://x.org/*a*_b_ z_w", "x\\_y https://x.org/*a*_b_ z\\_w"},
+		{"heading", "# not heading", "\\# not heading"},
+		{"block quote", "> quote", "\\> quote"},
+		{"list item", "- item\n+ item", "\\- item\n\\+ item"},
+		{"ordered list item", "1. one\n  2) two", "1\\. one\n  2\\) two"},
+		{"setext underline", "title\n===", "title\n\\==="},
+		{"block syntax mid-line", "a # b > c - d", "a # b > c - d"},
+		{"block syntax after environment", "@b{x}\n- y", "**x**\n\\- y"},
+	} {
+		if got := ToMarkdown(c.in); got != c.want {
+			t.Errorf("%s: ToMarkdown(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestFromMarkdown(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"plain", "plain", "plain"},
+		{"emphasis", "**bold** and _it_", "@b{bold} and @i{it}"},
+		{"bold italic", "***both***", "@i{@b{both}}"},
+		{"heading", "# Heading", "@b{Heading}"},
+		{"markup in text", "a @b{x} b", "a @@b{x} b"},
+		{"email address", "mail user@mit.edu", "mail user@mit.edu"},
+		{"literal at signs", "a @@ b", "a @@@@ b"},
+		{"escaped markup in text", "a @@b{x} c", "a @@@@b{x} c"},
+		{"markup in code span", "`@b{x}`", "`@@b{x}`"},
+		{"escaped markup in code span", "`@@b{x}`", "`@@@@b{x}`"},
+		{"markup in fenced code", "```\n@b{x}\n```", "@@b{x}"},
+		{"markup in indented code", "    @i(y)", "@@i(y)"},
+		{"brace inside", "**a}b**", "@b(a}b)"},
+		{"two closers inside", "**a}b)c**", "@b[a}b)c]"},
+		{"three closers inside", "**a}b)c]d**", "@b<a}b)c]d>"},
+		{"all closers inside", "**a}b)c]d>e**", "@b{a@(})b)c]d>e}"},
+		{"all closers inside italic", "_x}y)z]w>v_", "@i{x@(})y)z]w>v}"},
+		{"escaped markup inside", "**a @i{x} b**", "@b(a @@i{x} b)"},
+		{"closers in nested environment", "**a _}b)c]d>_ e**", "@b{a @i{@(})b)c]d>} e}"},
+		{"links", "[site](https://example.com) and [again](https://example.com)", "site[1] and again[1]\n\n[1] https://example.com"},
+		{"link to itself", "[https://x.org](https://x.org)", "https://x.org"},
+		{"markup in autolink", "<https://x.org/@b{y}>", "https://x.org/@@b{y}"},
+		{"markup in link destination", "[x](https://x.org/@b{y})", "x[1]\n\n[1] https://x.org/@@b{y}"},
+		{"block quote", "> quoted\n> more", "> quoted\n> more"},
+		{"list", "* one\n* two", "* one\n* two"},
+		{"ordered list", "1. one\n2. two", "1. one\n2. two"},
+		{"thematic break", "---", "----"},
+		{"backslash escape", "a\\*b", "a*b"},
+		{"entities", "&amp; &lt;", "& <"},
+	} {
+		if got := FromMarkdown(c.in); got != c.want {
+			t.Errorf("%s: FromMarkdown(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+// TestFromMarkdownRoundTrip checks that the markup FromMarkdown writes is
+// parsed as intended, by converting it back.
+func TestFromMarkdownRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		"**bold** and *it*",
+		"a @b{x} b",
+		"a @@b{x} c",
+		"a @@ b",
+		"**a}b**",
+		"**a}b)c>d**",
+		"**a}b)c>d\\]e**",
+		"*x **y}z)w>v\\]u** t*",
+	} {
+		if got := ToMarkdown(FromMarkdown(in)); got != in {
+			t.Errorf("ToMarkdown(FromMarkdown(%q)) = %q", in, got)
+		}
+	}
+}
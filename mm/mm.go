@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,25 +16,65 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-type listener struct {
-	channelID string
-	ch        chan<- PostNotification
-}
-
 type Bot struct {
 	//webSocketClient *model.WebSocketClient
-	client   *model.Client4
-	user     *model.User
-	team     *model.Team
-	channels map[string]*model.Channel
-	close    func()
+	client *model.Client4
+	user   *model.User
+	// team is the default team, used for channels when no team is named.
+	team *team
+	// teams are the teams the bot works on, by name.
+	teams map[string]*team
+	close func()
+
+	cacheMu sync.Mutex
+	// channelTeams caches the team of each channel, by ID.
+	channelTeams map[string]*team
 
 	mu          sync.Mutex
-	listeners   []listener
+	postsCh     chan<- PostNotification
 	personalsCh chan<- PostNotification
 }
 
-func New(url, token string) (*Bot, error) {
+// New connects to Mattermost and looks up the named teams, the first of which
+// is the default team.
+func New(url, token string, teams []string) (*Bot, error) {
+	b, err := connect(url, token, teams)
+	if err != nil {
+		return nil, err
+	}
+	for _, tm := range b.teams {
+		channels, err := b.publicChannels(tm)
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range channels {
+			log.Printf("found channel: %#v", ch)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go b.listenLoop(ctx, token)
+	b.close = cancel
+
+	return b, nil
+}
+
+// NewLookup is like New, but the bot only looks things up: it doesn't list the
+// teams' channels or listen for posts.
+func NewLookup(url, token string, teams []string) (*Bot, error) {
+	b, err := connect(url, token, teams)
+	if err != nil {
+		return nil, err
+	}
+	b.close = func() {}
+	return b, nil
+}
+
+// connect logs in to Mattermost and looks up the named teams.
+func connect(url, token string, teams []string) (*Bot, error) {
+	if len(teams) == 0 {
+		return nil, errors.New("no teams named")
+	}
 	client := model.NewAPIv4Client(url)
 	// Check if server is running
 	if props, resp := client.GetOldClientConfig(""); resp.Error != nil {
@@ -45,43 +87,27 @@ func New(url, token string) (*Bot, error) {
 	if resp.Error != nil {
 		return nil, resp.Error
 	}
-	teams, resp := client.GetAllTeams("", 0, 2)
-	if resp.Error != nil {
-		return nil, resp.Error
-	}
-
-	// Handle multiple Teams by finding the one called "SIPB"
-	var team *model.Team
-	team, resp = client.GetTeamByName("sipb", "")
 
 	b := &Bot{
-		client:   client,
-		user:     user,
-		team:     team,
-		channels: make(map[string]*model.Channel),
+		client:       client,
+		user:         user,
+		teams:        make(map[string]*team),
+		channelTeams: make(map[string]*team),
 	}
-
-	// TODO: Parse channel headers for class/instance information?
-	etag := ""
-	for page := 0; true; page++ {
-		channels, resp := client.GetPublicChannelsForTeam(teams[0].Id, page, 60, etag)
+	for _, name := range teams {
+		t, resp := client.GetTeamByName(strings.ToLower(name), "")
 		if resp.Error != nil {
-			return nil, resp.Error
+			return nil, fmt.Errorf("looking up team %q: %w", name, resp.Error)
 		}
-		etag = resp.Etag
-		for _, ch := range channels {
-			log.Printf("found channel: %#v", ch)
-			b.channels[ch.Name] = ch
+		tm := &team{
+			Team:     t,
+			channels: make(map[string]*model.Channel),
 		}
-		if len(channels) < 60 {
-			break
+		b.teams[t.Name] = tm
+		if b.team == nil {
+			b.team = tm
 		}
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	go b.listenLoop(ctx, token)
-	b.close = cancel
-
 	return b, nil
 }
 
@@ -129,6 +155,31 @@ func (bot *Bot) listen(ctx context.Context, token string) error {
 					Post:        post,
 					ChannelType: ev.GetData()["channel_type"].(string),
 					Sender:      sender,
+					Event:       ev.Event,
+				})
+			case model.WEBSOCKET_EVENT_POST_EDITED, model.WEBSOCKET_EVENT_POST_DELETED:
+				// Edit and delete events don't carry the sender's name, so look it up.
+				post := model.PostFromJson(strings.NewReader(ev.GetData()["post"].(string)))
+				bot.handlePost(PostNotification{
+					Post:   post,
+					Sender: bot.senderName(post.UserId),
+					Event:  ev.Event,
+				})
+			case model.WEBSOCKET_EVENT_REACTION_ADDED, model.WEBSOCKET_EVENT_REACTION_REMOVED:
+				reaction := model.ReactionFromJson(strings.NewReader(ev.GetData()["reaction"].(string)))
+				if reaction == nil || ev.GetBroadcast() == nil {
+					log.Printf("bad reaction event: %#v", ev)
+					continue
+				}
+				// The post and the user who reacted are only looked up, by
+				// LookUpReaction, for reactions that are relayed.
+				bot.handlePost(PostNotification{
+					Post: &model.Post{
+						Id:        reaction.PostId,
+						ChannelId: ev.GetBroadcast().ChannelId,
+					},
+					Event:    ev.Event,
+					Reaction: reaction,
 				})
 			default:
 				log.Printf("received mattermost event: %#v", ev)
@@ -150,15 +201,14 @@ func (bot *Bot) listen(ctx context.Context, token string) error {
 func (bot *Bot) handlePost(post PostNotification) {
 	bot.mu.Lock()
 	defer bot.mu.Unlock()
-	if post.ChannelType == model.CHANNEL_DIRECT && bot.personalsCh != nil {
-		bot.personalsCh <- post
-		return
-	}
-	for _, l := range bot.listeners {
-		if l.channelID == post.Post.ChannelId {
-			l.ch <- post
+	if post.ChannelType == model.CHANNEL_DIRECT {
+		if bot.personalsCh != nil {
+			bot.personalsCh <- post
 			return
 		}
+	} else if bot.postsCh != nil {
+		bot.postsCh <- post
+		return
 	}
 	log.Printf("unhandled post from %q: %#v", post.Sender, post.Post)
 }
@@ -167,8 +217,8 @@ func (bot *Bot) Close() {
 	bot.close()
 	bot.mu.Lock()
 	defer bot.mu.Unlock()
-	for _, l := range bot.listeners {
-		close(l.ch)
+	if bot.postsCh != nil {
+		close(bot.postsCh)
 	}
 	if bot.personalsCh != nil {
 		close(bot.personalsCh)
@@ -179,6 +229,40 @@ type PostNotification struct {
 	Post        *model.Post
 	Sender      string
 	ChannelType string
+	// Event is the websocket event that produced the notification: one of
+	// model.WEBSOCKET_EVENT_POSTED, _POST_EDITED, _POST_DELETED, _REACTION_ADDED
+	// or _REACTION_REMOVED.
+	Event string
+	// Reaction is set for reaction events. Their Post only has the ID and
+	// channel of the post reacted to, and their Sender is empty, until they
+	// are filled in by LookUpReaction.
+	Reaction *model.Reaction
+}
+
+// LookUpReaction fills in the post reacted to and the user who reacted in a
+// reaction notification.
+func (bot *Bot) LookUpReaction(post *PostNotification) error {
+	p, resp := bot.client.GetPost(post.Reaction.PostId, "")
+	if resp.Error != nil {
+		return fmt.Errorf("looking up post %q: %w", post.Reaction.PostId, resp.Error)
+	}
+	user, resp := bot.client.GetUser(post.Reaction.UserId, "")
+	if resp.Error != nil {
+		return fmt.Errorf("looking up user %q: %w", post.Reaction.UserId, resp.Error)
+	}
+	post.Post = p
+	post.Sender = "@" + user.Username
+	return nil
+}
+
+// senderName returns the "@username" form of a user's name, as used in PostNotification.Sender.
+func (bot *Bot) senderName(userId string) string {
+	user, resp := bot.client.GetUser(userId, "")
+	if resp.Error != nil {
+		log.Printf("looking up user %q: %v", userId, resp.Error)
+		return ""
+	}
+	return "@" + user.Username
 }
 
 func (bot *Bot) ListenPersonals() <-chan PostNotification {
@@ -189,15 +273,31 @@ func (bot *Bot) ListenPersonals() <-chan PostNotification {
 	return ch
 }
 
-// Like ListenChannel, but doesn't listen; only prepares for transmission.
-func (bot *Bot) AttachChannel(channel_name string) (*model.Channel, error) {
+// ListenChannels returns a channel of the posts in all the channels the bot
+// has joined, other than direct messages.
+func (bot *Bot) ListenChannels() <-chan PostNotification {
+	ch := make(chan PostNotification)
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.postsCh = ch
+	return ch
+}
+
+// AttachChannel looks up a public channel on the named team, or the default
+// team if team is empty, joining it if necessary. Private channels are refused;
+// see AttachPrivateChannel.
+// Posts in the channel are delivered to the channel returned by ListenChannels.
+func (bot *Bot) AttachChannel(team, channel_name string) (*model.Channel, error) {
 	// Make sure the bot has joined the channel
-	ch, resp := bot.client.GetChannelByName(channel_name, bot.team.Id, "")
-	if resp.Error != nil {
-		return nil, resp.Error
+	ch, err := bot.GetChannelByName(team, channel_name)
+	if err != nil {
+		return nil, err
 	}
 	log.Print(ch)
-	_, resp = bot.client.GetChannelMember(ch.Id, bot.user.Id, "")
+	if ch.Type != model.CHANNEL_OPEN {
+		return nil, fmt.Errorf("channel %q is not public", channel_name)
+	}
+	_, resp := bot.client.GetChannelMember(ch.Id, bot.user.Id, "")
 	if resp.StatusCode == 404 {
 		if _, resp := bot.client.AddChannelMember(ch.Id, bot.user.Id); resp.Error != nil {
 			return ch, resp.Error
@@ -208,21 +308,57 @@ func (bot *Bot) AttachChannel(channel_name string) (*model.Channel, error) {
 	return ch, nil
 }
 
-func (bot *Bot) ListenChannel(channel_name string) (*model.Channel, <-chan PostNotification, error) {
-	// Make sure the bot has joined the channel
-	ch, err := bot.AttachChannel(channel_name)
+// AttachPrivateChannel is like AttachChannel, but for private channels. The
+// bot never joins a private channel itself; it must have been invited.
+func (bot *Bot) AttachPrivateChannel(team, channel_name string) (*model.Channel, error) {
+	ch, err := bot.GetChannelByName(team, channel_name)
 	if err != nil {
-		return ch, nil, err
+		return nil, err
 	}
-	// Subscribe to posts
-	postCh := make(chan PostNotification)
-	bot.mu.Lock()
-	defer bot.mu.Unlock()
-	bot.listeners = append(bot.listeners, listener{
-		channelID: ch.Id,
-		ch:        postCh,
-	})
-	return ch, postCh, nil
+	log.Print(ch)
+	if ch.Type != model.CHANNEL_PRIVATE {
+		return nil, fmt.Errorf("channel %q is not private", channel_name)
+	}
+	_, resp := bot.client.GetChannelMember(ch.Id, bot.user.Id, "")
+	if resp.StatusCode == 404 {
+		return nil, fmt.Errorf("the bot has not been invited to channel %q", channel_name)
+	} else if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return ch, nil
+}
+
+// GetPublicChannels lists the public channels on the named team, or the
+// default team if team is empty, including those the bot hasn't joined.
+func (bot *Bot) GetPublicChannels(team string) ([]*model.Channel, error) {
+	t, err := bot.lookupTeam(team)
+	if err != nil {
+		return nil, err
+	}
+	return bot.publicChannels(t)
+}
+
+// GetChannelByName looks up a channel on the named team, or the default team
+// if team is empty, without joining it.
+func (bot *Bot) GetChannelByName(team, channel_name string) (*model.Channel, error) {
+	t, err := bot.lookupTeam(team)
+	if err != nil {
+		return nil, err
+	}
+	ch, resp := bot.client.GetChannelByName(channel_name, t.Id, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	bot.cacheChannel(t, ch)
+	return ch, nil
+}
+
+func (bot *Bot) GetUserByUsername(username string) (*model.User, error) {
+	user, resp := bot.client.GetUserByUsername(username, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return user, nil
 }
 
 func (bot *Bot) UpdateChannelHeader(channel *model.Channel, header string) error {
@@ -241,19 +377,109 @@ func (bot *Bot) GetPostThread(postId string) (*model.PostList, error) {
 	return pl, nil
 }
 
+func (bot *Bot) GetFileInfosForPost(postId string) ([]*model.FileInfo, error) {
+	infos, resp := bot.client.GetFileInfosForPost(postId, "")
+	if resp.Error != nil {
+		return infos, resp.Error
+	}
+	return infos, nil
+}
+
+// GetFileLink returns a public link to a file.
+// It fails if public links are disabled on the server.
+func (bot *Bot) GetFileLink(fileId string) (string, error) {
+	link, resp := bot.client.GetFileLink(fileId)
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	return link, nil
+}
+
 func (bot *Bot) GetPostLink(post *model.Post) string {
-	return fmt.Sprintf("%s/%s/pl/%s", bot.client.Url, bot.team.Name, post.Id)
+	return fmt.Sprintf("%s/%s/pl/%s", bot.client.Url, bot.channelTeam(post.ChannelId).Name, post.Id)
+}
+
+// PostError is returned when Mattermost fails to create a post.
+type PostError struct {
+	// StatusCode is the HTTP status of the response, or 0 if there was no response.
+	StatusCode int
+	// RetryAfter is how long the server asked us to wait before trying again, if it said.
+	RetryAfter time.Duration
+	Err        *model.AppError
+}
+
+func newPostError(resp *model.Response) *PostError {
+	e := &PostError{
+		StatusCode: resp.StatusCode,
+		Err:        resp.Error,
+	}
+	// Retry-After is set on rate-limited responses; X-Ratelimit-Reset on all
+	// responses from a rate-limited server.
+	for _, header := range []string{"Retry-After", "X-Ratelimit-Reset"} {
+		if seconds, err := strconv.Atoi(resp.Header.Get(header)); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+	return e
+}
+
+func (e *PostError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PostError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the post might succeed if retried later.
+func (e *PostError) Temporary() bool {
+	return temporaryStatus(e.StatusCode)
 }
 
+// Temporary reports whether a request that failed with err might succeed if
+// retried later. Errors that didn't come from Mattermost are assumed to be
+// temporary.
+func Temporary(err error) bool {
+	var perr *PostError
+	if errors.As(err, &perr) {
+		return perr.Temporary()
+	}
+	var appErr *model.AppError
+	if errors.As(err, &appErr) {
+		return temporaryStatus(appErr.StatusCode)
+	}
+	return true
+}
+
+func temporaryStatus(code int) bool {
+	return code == 0 || code == http.StatusTooManyRequests || code >= 500
+}
+
+// SendPost creates post. Errors from Mattermost are returned as a *PostError.
 func (bot *Bot) SendPost(post *model.Post) (*model.Post, error) {
 	post.AddProp("from_webhook", "true")
 	post, resp := bot.client.CreatePost(post)
 	if resp.Error != nil {
-		return nil, resp.Error
+		return nil, newPostError(resp)
 	}
 	return post, nil
 }
 
+// GetDirectChannel returns the direct message channel between the bot and the
+// named user, creating it if necessary.
+func (bot *Bot) GetDirectChannel(username string) (*model.Channel, error) {
+	user, resp := bot.client.GetUserByUsername(username, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	ch, resp := bot.client.CreateDirectChannel(bot.user.Id, user.Id)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return ch, nil
+}
+
 func (bot *Bot) SendMessageToChannel(channel *model.Channel, message string, props model.StringInterface) (*model.Post, error) {
 	post := &model.Post{
 		ChannelId: channel.Id,
@@ -281,7 +507,7 @@ func (bot *Bot) SendSpoofedMessageToChannel(name string) error {
 	}
 	if webhook == nil {
 		webhook, resp = bot.client.CreateIncomingWebhook(&model.IncomingWebhook{
-			ChannelId:   bot.channels[name].Id,
+			ChannelId:   bot.cachedChannel(bot.team, name).Id,
 			DisplayName: "zephyr",
 			Description: "Zephyr bridge",
 		})
@@ -0,0 +1,89 @@
+package mm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// team is a team the bot works on.
+type team struct {
+	*model.Team
+	// channels caches the team's channels by name. It is guarded by Bot.cacheMu.
+	channels map[string]*model.Channel
+}
+
+// lookupTeam returns the named team, or the default team if name is empty.
+func (bot *Bot) lookupTeam(name string) (*team, error) {
+	if name == "" {
+		return bot.team, nil
+	}
+	t, ok := bot.teams[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("team %q is not one of the bot's teams", name)
+	}
+	return t, nil
+}
+
+// publicChannels lists all the public channels on a team.
+func (bot *Bot) publicChannels(t *team) ([]*model.Channel, error) {
+	var all []*model.Channel
+	for page := 0; true; page++ {
+		channels, resp := bot.client.GetPublicChannelsForTeam(t.Id, page, 60, "")
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		for _, ch := range channels {
+			bot.cacheChannel(t, ch)
+		}
+		all = append(all, channels...)
+		if len(channels) < 60 {
+			break
+		}
+	}
+	return all, nil
+}
+
+// cacheChannel records that ch is on t.
+func (bot *Bot) cacheChannel(t *team, ch *model.Channel) {
+	bot.cacheMu.Lock()
+	defer bot.cacheMu.Unlock()
+	t.channels[ch.Name] = ch
+	bot.channelTeams[ch.Id] = t
+}
+
+// cachedChannel returns the cached channel on t with the given name, if any.
+func (bot *Bot) cachedChannel(t *team, name string) *model.Channel {
+	bot.cacheMu.Lock()
+	defer bot.cacheMu.Unlock()
+	return t.channels[name]
+}
+
+// channelTeam returns the team a channel is on. Channels that aren't on one of
+// the bot's teams, like direct messages, are treated as being on the default
+// team.
+func (bot *Bot) channelTeam(channelId string) *team {
+	bot.cacheMu.Lock()
+	t, ok := bot.channelTeams[channelId]
+	bot.cacheMu.Unlock()
+	if ok {
+		return t
+	}
+	ch, resp := bot.client.GetChannel(channelId, "")
+	if resp.Error != nil {
+		log.Printf("looking up channel %q: %v", channelId, resp.Error)
+		return bot.team
+	}
+	t = bot.team
+	for _, candidate := range bot.teams {
+		if candidate.Id == ch.TeamId {
+			t = candidate
+		}
+	}
+	bot.cacheMu.Lock()
+	defer bot.cacheMu.Unlock()
+	bot.channelTeams[channelId] = t
+	return t
+}
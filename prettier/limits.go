@@ -0,0 +1,32 @@
+package prettier
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned when formatting a message takes longer than Limits.Timeout.
+	ErrTimeout = errors.New("prettier: formatting timed out")
+	// ErrTooLarge is returned for messages longer than Limits.MaxInput.
+	ErrTooLarge = errors.New("prettier: message too large to format")
+)
+
+// Limits bound the resources spent formatting messages. Zero means no limit.
+type Limits struct {
+	// Timeout is how long formatting a single message may take.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxInput is the size in bytes of the largest message that will be formatted.
+	MaxInput int `yaml:"max_input"`
+	// MaxUses is how many messages a JavaScript context formats before it is
+	// replaced by a fresh one, so that its memory use can't grow forever.
+	MaxUses int `yaml:"max_uses"`
+}
+
+func (l Limits) checkInput(in string) error {
+	if l.MaxInput > 0 && len(in) > l.MaxInput {
+		return fmt.Errorf("%w (%d bytes)", ErrTooLarge, len(in))
+	}
+	return nil
+}
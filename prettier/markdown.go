@@ -0,0 +1,955 @@
+package prettier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// errUnsupported is returned by the native formatter for input it can't
+// format the way prettier would. Callers should fall back to the raw text.
+var errUnsupported = errors.New("unsupported markdown")
+
+var markdownParser = goldmark.New(goldmark.WithExtensions(
+	extension.Table,
+	extension.Strikethrough,
+	extension.Linkify,
+	extension.TaskList,
+)).Parser()
+
+// formatter is a native reimplementation of prettier's Markdown printer.
+// It reproduces prettier's output for the Markdown that shows up in chat
+// messages, and refuses the rest (link reference definitions, front matter)
+// rather than guess.
+type formatter struct {
+	proseWrap  string
+	printWidth int
+	tabWidth   int
+}
+
+// newFormatter creates a formatter for the given prettier options.
+// Options that don't affect Markdown output are ignored, like prettier does.
+func newFormatter(options map[string]interface{}) (*formatter, error) {
+	f := &formatter{
+		proseWrap:  "preserve",
+		printWidth: 80,
+		tabWidth:   2,
+	}
+	for key, value := range options {
+		var err error
+		switch key {
+		case "parser":
+			if value != "markdown" {
+				err = errors.New(`only "markdown" is supported`)
+			}
+		case "proseWrap":
+			switch value {
+			case "always", "never", "preserve":
+				f.proseWrap = value.(string)
+			default:
+				err = errors.New(`must be "always", "never" or "preserve"`)
+			}
+		case "printWidth":
+			f.printWidth, err = intOption(value)
+		case "tabWidth":
+			f.tabWidth, err = intOption(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("prettier option %s: %w", key, err)
+		}
+	}
+	return f, nil
+}
+
+func intOption(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		if v > 0 {
+			return v, nil
+		}
+	case float64:
+		if v > 0 && v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, errors.New("must be a positive integer")
+}
+
+// frontMatterRE matches YAML front matter, which prettier leaves alone.
+var frontMatterRE = regexp.MustCompile(`^---[ \t]*\n(?s:.*?\n)?---[ \t]*(\n|$)`)
+
+func (f *formatter) format(in string) (string, error) {
+	in = strings.ReplaceAll(in, "\r\n", "\n")
+	if frontMatterRE.MatchString(in) {
+		return "", fmt.Errorf("%w: front matter", errUnsupported)
+	}
+	source := []byte(in)
+	pc := parser.NewContext()
+	doc := markdownParser.Parse(text.NewReader(source), parser.WithContext(pc))
+	if len(pc.References()) > 0 {
+		// goldmark resolves reference links while parsing, so they
+		// can't be printed back as written.
+		return "", fmt.Errorf("%w: link reference definitions", errUnsupported)
+	}
+	p := &printer{formatter: f, source: source}
+	lines := p.blocks(doc, f.printWidth)
+	if p.err != nil {
+		return "", p.err
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// printer prints a parsed document. Blocks are printed as lines without
+// their container's indentation; containers add their own prefixes.
+type printer struct {
+	*formatter
+	source []byte
+	err    error
+}
+
+func (p *printer) unsupported(n ast.Node) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%w: %s", errUnsupported, n.Kind())
+	}
+}
+
+// blocks prints the block children of n, filling paragraphs to width.
+func (p *printer) blocks(n ast.Node, width int) []string {
+	var lines []string
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if prev := c.PreviousSibling(); prev != nil {
+			lines = append(lines, p.separator(prev, c)...)
+		}
+		lines = append(lines, p.block(c, width)...)
+	}
+	return lines
+}
+
+// separator returns the blank lines printed between sibling blocks.
+func (p *printer) separator(prev, n ast.Node) []string {
+	switch {
+	case prev.Kind() == ast.KindList && n.Kind() == ast.KindCodeBlock:
+		// Otherwise the code would continue the list.
+		return []string{"", ""}
+	case n.Parent().Kind() == ast.KindListItem && !p.isLoose(n.Parent()):
+		return nil
+	}
+	return []string{""}
+}
+
+func (p *printer) block(n ast.Node, width int) []string {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return p.fill(p.inlines(n, false), width)
+	case *ast.Heading:
+		lines := p.fill(p.inlines(n, true), width)
+		if len(lines) == 0 {
+			lines = []string{""}
+		}
+		return prefix(lines, strings.Repeat("#", n.Level)+" ", "")
+	case *ast.ThematicBreak:
+		for a := n.Parent(); a != nil; a = a.Parent() {
+			if list, ok := a.(*ast.List); ok {
+				if nthSiblingIndex(list)%2 == 0 {
+					return []string{"***"}
+				}
+				break
+			}
+		}
+		return []string{"---"}
+	case *ast.CodeBlock:
+		return prefix(p.rawLines(n), "    ", "    ")
+	case *ast.FencedCodeBlock:
+		value := strings.Join(p.rawLines(n), "\n")
+		fence := strings.Repeat("`", max(3, maxRun(value, '`')+1))
+		info := ""
+		if n.Info != nil {
+			info = strings.TrimSpace(string(n.Info.Text(p.source)))
+			if i := strings.IndexAny(info, " \t"); i >= 0 {
+				info = info[:i] + " " + strings.TrimSpace(info[i:])
+			}
+		}
+		lines := append([]string{fence + info}, strings.Split(value, "\n")...)
+		return append(lines, fence)
+	case *ast.HTMLBlock:
+		lines := p.rawLines(n)
+		if n.HasClosure() {
+			lines = append(lines, strings.TrimSuffix(string(n.ClosureLine.Value(p.source)), "\n"))
+		}
+		if n.Parent().Kind() == ast.KindDocument && n.NextSibling() == nil {
+			for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+				lines = lines[:len(lines)-1]
+			}
+			if len(lines) > 0 {
+				lines[len(lines)-1] = strings.TrimRightFunc(lines[len(lines)-1], unicode.IsSpace)
+			}
+		}
+		return lines
+	case *ast.Blockquote:
+		return prefix(p.blocks(n, width-2), "> ", "> ")
+	case *ast.List:
+		return p.list(n, width)
+	case *east.Table:
+		return p.table(n)
+	}
+	p.unsupported(n)
+	return nil
+}
+
+// rawLines returns the source lines of a leaf block, without line endings.
+func (p *printer) rawLines(n ast.Node) []string {
+	var sb strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		sb.Write(line.Value(p.source))
+	}
+	value := strings.TrimSuffix(sb.String(), "\n")
+	return strings.Split(value, "\n")
+}
+
+// prefix prepends first to the first line and rest to the others.
+// Prefixes aren't allowed to leave trailing whitespace on blank lines.
+func prefix(lines []string, first, rest string) []string {
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		pre := rest
+		if i == 0 {
+			pre = first
+		}
+		if line == "" {
+			out[i] = strings.TrimRight(pre, " ")
+		} else {
+			out[i] = pre + line
+		}
+	}
+	return out
+}
+
+func (p *printer) list(n *ast.List, width int) []string {
+	nth := nthSiblingIndex(n)
+	aligned := p.isAligned(n) || hasIndentedCode(n)
+	var lines []string
+	i := 0
+	for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+		var marker string
+		if n.IsOrdered() {
+			number := n.Start
+			if i > 0 {
+				if p.isGitDiffFriendly(n) {
+					number = 1
+				} else {
+					number += i
+				}
+			}
+			marker = fmt.Sprintf("%d. ", number)
+			if nth%2 != 0 {
+				marker = fmt.Sprintf("%d) ", number)
+			}
+		} else {
+			marker = "- "
+			if nth%2 != 0 {
+				marker = "* "
+			}
+		}
+		if aligned && len(marker)%p.tabWidth != 0 {
+			marker += strings.Repeat(" ", p.tabWidth-len(marker)%p.tabWidth)
+		}
+		if prev := item.PreviousSibling(); prev != nil && p.isLoose(prev) {
+			lines = append(lines, "")
+		}
+		body := p.listItem(item, marker, width-len(marker))
+		lines = append(lines, prefix(body, marker, strings.Repeat(" ", len(marker)))...)
+		i++
+	}
+	return lines
+}
+
+func (p *printer) listItem(item ast.Node, marker string, width int) []string {
+	checkbox := ""
+	if first := item.FirstChild(); first != nil {
+		if box, ok := first.FirstChild().(*east.TaskCheckBox); ok {
+			checkbox = "[ ] "
+			if box.IsChecked {
+				checkbox = "[x] "
+			}
+		}
+	}
+	var lines []string
+	for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+		if prev := c.PreviousSibling(); prev != nil {
+			lines = append(lines, p.separator(prev, c)...)
+		}
+		if c == item.FirstChild() && c.Kind() != ast.KindList {
+			indent := strings.Repeat(" ", len(checkbox))
+			lines = append(lines, prefix(p.block(c, width-len(checkbox)), checkbox, indent)...)
+			continue
+		}
+		// Nested blocks line up with tab stops, but never so far that
+		// they'd turn into indented code.
+		indent := strings.Repeat(" ", clamp(p.tabWidth-len(marker), 0, 3))
+		lines = append(lines, prefix(p.block(c, width-len(indent)), indent, indent)...)
+	}
+	return lines
+}
+
+// nthSiblingIndex counts how many lists of the same kind immediately precede
+// list. Adjacent lists alternate markers so they don't merge.
+func nthSiblingIndex(list *ast.List) int {
+	index := -1
+	for c := list.Parent().FirstChild(); c != nil; c = c.NextSibling() {
+		if other, ok := c.(*ast.List); ok && other.IsOrdered() == list.IsOrdered() {
+			index++
+		} else {
+			index = -1
+		}
+		if c == list {
+			break
+		}
+	}
+	return index
+}
+
+// isLoose reports whether a list item is followed by, or contains, a blank line.
+func (p *printer) isLoose(item ast.Node) bool {
+	if item.FirstChild() == nil {
+		return false
+	}
+	start, end := p.span(item)
+	if p.hasBlankLine(start, end) {
+		return true
+	}
+	if next := item.NextSibling(); next != nil {
+		nextStart, _ := p.span(next)
+		return p.hasBlankLine(end, nextStart)
+	}
+	return false
+}
+
+// span returns the extent of the source segments within n.
+func (p *printer) span(n ast.Node) (start, end int) {
+	start, end = -1, -1
+	add := func(s text.Segment) {
+		if start < 0 || s.Start < start {
+			start = s.Start
+		}
+		if s.Stop > end {
+			end = s.Stop
+		}
+	}
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		if t, ok := n.(*ast.Text); ok {
+			add(t.Segment)
+		}
+		if n.Type() == ast.TypeBlock {
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				add(lines.At(i))
+			}
+			if code, ok := n.(*ast.FencedCodeBlock); ok && code.Info != nil {
+				add(code.Info.Segment)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	if start < 0 {
+		start, end = 0, 0
+	}
+	return start, end
+}
+
+// hasBlankLine reports whether a blank line lies between offsets start and end.
+func (p *printer) hasBlankLine(start, end int) bool {
+	if start >= end {
+		return false
+	}
+	// Segments may or may not include their trailing newline; back up so
+	// that the line containing start is skipped either way.
+	if start > 0 && p.source[start-1] == '\n' {
+		start--
+	}
+	lines := strings.Split(string(p.source[start:end]), "\n")
+	if len(lines) < 3 {
+		return false
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if strings.TrimSpace(line) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+var orderedMarkerRE = regexp.MustCompile(`(\d+)[.)]( *)$`)
+
+// itemInfo returns the number and the spaces after the marker of an ordered
+// list item, and the column its content starts at.
+func (p *printer) itemInfo(item ast.Node) (number int, spaces int, column int) {
+	start, _ := p.span(item)
+	lineStart := strings.LastIndexByte(string(p.source[:start]), '\n') + 1
+	column = utf8.RuneCount(p.source[lineStart:start])
+	m := orderedMarkerRE.FindSubmatch(p.source[lineStart:start])
+	if m == nil {
+		return -1, 0, column
+	}
+	fmt.Sscan(string(m[1]), &number)
+	return number, len(m[2]), column
+}
+
+// isAligned reports whether a list's content was written aligned to tab
+// stops, in which case prettier pads the markers to keep it that way.
+func (p *printer) isAligned(list *ast.List) bool {
+	for a := list.Parent(); a != nil; a = a.Parent() {
+		if parent, ok := a.(*ast.List); ok && !p.isAligned(parent) {
+			return false
+		}
+	}
+	if !list.IsOrdered() {
+		return true
+	}
+	first := list.FirstChild()
+	_, spaces, firstColumn := p.itemInfo(first)
+	if spaces > 1 {
+		return true
+	}
+	if first.FirstChild() == nil {
+		return false
+	}
+	second := first.NextSibling()
+	if second == nil {
+		return firstColumn%p.tabWidth == 0
+	}
+	_, spaces, secondColumn := p.itemInfo(second)
+	if firstColumn != secondColumn {
+		return false
+	}
+	if firstColumn%p.tabWidth == 0 {
+		return true
+	}
+	return spaces > 1
+}
+
+// isGitDiffFriendly reports whether an ordered list numbers every item
+// after the first as 1, which prettier preserves.
+func (p *printer) isGitDiffFriendly(list *ast.List) bool {
+	first := list.FirstChild()
+	if first == nil || first.NextSibling() == nil {
+		return false
+	}
+	firstNumber, _, _ := p.itemInfo(first)
+	secondNumber, _, _ := p.itemInfo(first.NextSibling())
+	if third := first.NextSibling().NextSibling(); firstNumber == 0 && third != nil {
+		thirdNumber, _, _ := p.itemInfo(third)
+		return secondNumber == 1 && thirdNumber == 1
+	}
+	return secondNumber == 1
+}
+
+func hasIndentedCode(list *ast.List) bool {
+	found := false
+	ast.Walk(list, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n.Kind() == ast.KindCodeBlock {
+			found = true
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return found
+}
+
+func (p *printer) table(n *east.Table) []string {
+	var rows [][]string
+	for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []string
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			cells = append(cells, strings.Join(p.fill(p.inlines(cell, true), 0), "\n"))
+		}
+		rows = append(rows, cells)
+	}
+	widths := make([]int, len(n.Alignments))
+	for i := range widths {
+		widths[i] = 3
+		for _, cells := range rows {
+			if i < len(cells) {
+				widths[i] = max(widths[i], stringWidth(cells[i]))
+			}
+		}
+	}
+	printRow := func(cells []string) string {
+		parts := make([]string, len(widths))
+		for i, width := range widths {
+			cell := ""
+			if i < len(cells) {
+				cell = cells[i]
+			}
+			spaces := width - stringWidth(cell)
+			switch n.Alignments[i] {
+			case east.AlignRight:
+				parts[i] = strings.Repeat(" ", spaces) + cell
+			case east.AlignCenter:
+				left := spaces / 2
+				parts[i] = strings.Repeat(" ", left) + cell + strings.Repeat(" ", spaces-left)
+			default:
+				parts[i] = cell + strings.Repeat(" ", spaces)
+			}
+		}
+		return "| " + strings.Join(parts, " | ") + " |"
+	}
+	lines := []string{printRow(rows[0])}
+	delimiters := make([]string, len(widths))
+	for i, width := range widths {
+		align := n.Alignments[i]
+		first, last := "-", "-"
+		if align == east.AlignLeft || align == east.AlignCenter {
+			first = ":"
+		}
+		if align == east.AlignRight || align == east.AlignCenter {
+			last = ":"
+		}
+		delimiters[i] = first + strings.Repeat("-", width-2) + last
+	}
+	lines = append(lines, "| "+strings.Join(delimiters, " | ")+" |")
+	for _, cells := range rows[1:] {
+		lines = append(lines, printRow(cells))
+	}
+	return lines
+}
+
+// A token is a piece of inline content.
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type tokenKind int
+
+const (
+	// tokenText is text printed as-is. Adjacent text is never broken apart.
+	tokenText tokenKind = iota
+	// tokenLine is whitespace that becomes a line break if the next
+	// text doesn't fit.
+	tokenLine
+	// tokenHardline is a forced line break.
+	tokenHardline
+)
+
+// fill prints tokens as lines of at most width columns, where possible.
+// A width of 0 means lines are only broken at hard line breaks.
+func (p *printer) fill(tokens []token, width int) []string {
+	var lines []string
+	var line strings.Builder
+	column := 0
+	sep := tokenText
+	started := false
+	for i := 0; i < len(tokens); {
+		if tokens[i].kind != tokenText {
+			if started && sep != tokenHardline {
+				sep = tokens[i].kind
+			}
+			i++
+			continue
+		}
+		var word strings.Builder
+		for ; i < len(tokens) && tokens[i].kind == tokenText; i++ {
+			word.WriteString(tokens[i].text)
+		}
+		w := stringWidth(word.String())
+		switch {
+		case sep == tokenHardline, sep == tokenLine && width > 0 && column+1+w > width:
+			lines = append(lines, line.String())
+			line.Reset()
+			column = 0
+		case sep == tokenLine:
+			line.WriteByte(' ')
+			column++
+		}
+		line.WriteString(word.String())
+		column += w
+		sep = tokenText
+		started = true
+	}
+	if started {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// blockMarkerRE matches words that would start a block if they began a line.
+var blockMarkerRE = regexp.MustCompile(`^>|^([*+-]|#{1,6}|\d+[).])$`)
+
+// inlines converts the inline children of n to tokens. Whitespace inside
+// single-line contexts (headings, links and table cells) is never broken.
+func (p *printer) inlines(n ast.Node, single bool) []token {
+	var tokens []token
+	var sentence []byte
+	flush := func() {
+		tokens = append(tokens, p.sentence(sentence, single, len(tokens) == 0)...)
+		sentence = nil
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if t, ok := c.(*ast.Text); ok {
+			sentence = append(sentence, t.Segment.Value(p.source)...)
+			if t.SoftLineBreak() {
+				sentence = append(sentence, '\n')
+			}
+			if t.HardLineBreak() {
+				flush()
+				if p.source[t.Segment.Stop] == '\\' {
+					tokens = append(tokens, token{tokenText, `\`})
+				} else {
+					tokens = append(tokens, token{tokenText, "  "})
+				}
+				tokens = append(tokens, token{kind: tokenHardline})
+			}
+			continue
+		}
+		flush()
+		tokens = append(tokens, p.inline(c, single)...)
+	}
+	flush()
+	return tokens
+}
+
+// sentence converts a run of text to tokens.
+func (p *printer) sentence(raw []byte, single, leading bool) []token {
+	var tokens []token
+	parts := splitWhitespace(string(raw))
+	for i, part := range parts {
+		if i%2 == 0 {
+			if part != "" {
+				tokens = append(tokens, token{tokenText, escapeWord(unescape(part))})
+			}
+			continue
+		}
+		if i == 1 && parts[0] == "" && leading {
+			continue
+		}
+		proseWrap := p.proseWrap
+		if i+1 < len(parts) && blockMarkerRE.MatchString(unescape(parts[i+1])) {
+			proseWrap = "never"
+		}
+		newline := strings.Contains(part, "\n")
+		switch {
+		case proseWrap == "preserve" && newline:
+			tokens = append(tokens, token{kind: tokenHardline})
+		case proseWrap == "always" && !single:
+			tokens = append(tokens, token{kind: tokenLine})
+		default:
+			tokens = append(tokens, token{tokenText, " "})
+		}
+	}
+	return tokens
+}
+
+var whitespaceRE = regexp.MustCompile(`[\t\n ]+`)
+
+// splitWhitespace splits s into alternating words and whitespace, starting
+// and ending with a (possibly empty) word.
+func splitWhitespace(s string) []string {
+	var parts []string
+	last := 0
+	for _, loc := range whitespaceRE.FindAllStringIndex(s, -1) {
+		parts = append(parts, s[last:loc[0]], s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	return append(parts, s[last:])
+}
+
+// unescape removes the backslash escapes that prettier drops when it parses
+// text. Other escapes and entities are printed as written.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && util.IsPunct(s[i+1]) {
+			if s[i+1] != '*' && s[i+1] != '_' {
+				sb.WriteByte('\\')
+			}
+			sb.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+var underscoreRE = regexp.MustCompile(`(^|\pP)(_+)|(_+)(\pP|$)`)
+
+// escapeWord escapes the characters in a word that would otherwise be read
+// as emphasis: every '*', and underscores at the edges of words.
+func escapeWord(s string) string {
+	s = strings.ReplaceAll(s, "*", `\*`)
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	var sb strings.Builder
+	last := 0
+	for _, m := range underscoreRE.FindAllStringIndex(s, -1) {
+		sb.WriteString(s[last:m[0]])
+		sb.WriteString(strings.ReplaceAll(s[m[0]:m[1]], "_", `\_`))
+		last = m[1]
+	}
+	sb.WriteString(s[last:])
+	return sb.String()
+}
+
+func (p *printer) inline(n ast.Node, single bool) []token {
+	switch n := n.(type) {
+	case *ast.Emphasis:
+		if inner, ok := n.FirstChild().(*ast.Emphasis); ok && n.Level == 1 && inner.Level == 2 && inner.NextSibling() == nil {
+			// prettier reads ***text*** as emphasis inside strong.
+			tokens := []token{{tokenText, "**_"}}
+			tokens = append(tokens, p.inlines(inner, single)...)
+			return append(tokens, token{tokenText, "_**"})
+		}
+		style := "**"
+		if n.Level == 1 {
+			style = "_"
+			if p.touchesWord(n) || hasEmphasisAncestor(n) {
+				style = "*"
+			}
+		}
+		tokens := []token{{tokenText, style}}
+		tokens = append(tokens, p.inlines(n, single)...)
+		return append(tokens, token{tokenText, style})
+	case *east.Strikethrough:
+		tokens := []token{{tokenText, "~~"}}
+		tokens = append(tokens, p.inlines(n, single)...)
+		return append(tokens, token{tokenText, "~~"})
+	case *ast.CodeSpan:
+		var sb strings.Builder
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if t, ok := c.(*ast.Text); ok {
+				sb.Write(t.Segment.Value(p.source))
+			}
+		}
+		value := sb.String()
+		count := minAbsentRun(value, '`')
+		style := strings.Repeat("`", max(count, 1))
+		gap := ""
+		if count > 0 {
+			gap = " "
+		}
+		return []token{{tokenText, style + gap + value + gap + style}}
+	case *ast.Link:
+		tokens := []token{{tokenText, "["}}
+		tokens = append(tokens, p.inlines(n, true)...)
+		url := printURL(resolve(n.Destination), " ", ")")
+		return append(tokens, token{tokenText, "](" + url + printTitle(resolve(n.Title)) + ")"})
+	case *ast.Image:
+		alt := ""
+		if n.FirstChild() != nil {
+			// Alt text is printed as written, including any markup.
+			start, end := p.span(n)
+			start = bytes.LastIndex(p.source[:start], []byte("![")) + 2
+			end += bytes.Index(p.source[end:], []byte("]("))
+			alt = string(p.source[start:end])
+		}
+		url := printURL(resolve(n.Destination), " ")
+		return []token{{tokenText, "![" + alt + "](" + url + printTitle(resolve(n.Title)) + ")"}}
+	case *ast.AutoLink:
+		label := n.Label(p.source)
+		// Label is a slice of the source, so its offset can be recovered
+		// from the capacities.
+		start := cap(p.source) - cap(label)
+		end := start + len(label)
+		if start > 0 && p.source[start-1] == '<' && end < len(p.source) && p.source[end] == '>' {
+			return []token{{tokenText, "<" + string(label) + ">"}}
+		}
+		return []token{{tokenText, string(label)}}
+	case *ast.RawHTML:
+		var sb strings.Builder
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			sb.Write(segment.Value(p.source))
+		}
+		var tokens []token
+		for i, line := range strings.Split(sb.String(), "\n") {
+			if i > 0 {
+				tokens = append(tokens, token{kind: tokenHardline})
+			}
+			tokens = append(tokens, token{tokenText, line})
+		}
+		return tokens
+	case *east.TaskCheckBox:
+		// Printed by the list item.
+		return nil
+	}
+	p.unsupported(n)
+	return nil
+}
+
+// touchesWord reports whether n is directly preceded or followed by a
+// word character, in which case '_' wouldn't work as emphasis.
+func (p *printer) touchesWord(n ast.Node) bool {
+	if t, ok := n.PreviousSibling().(*ast.Text); ok && !t.SoftLineBreak() && !t.HardLineBreak() {
+		r, _ := utf8.DecodeLastRune(t.Segment.Value(p.source))
+		if r != utf8.RuneError && !unicode.IsSpace(r) && !unicode.IsPunct(r) {
+			return true
+		}
+	}
+	if t, ok := n.NextSibling().(*ast.Text); ok {
+		r, _ := utf8.DecodeRune(t.Segment.Value(p.source))
+		if r != utf8.RuneError && !unicode.IsSpace(r) && !unicode.IsPunct(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEmphasisAncestor(n ast.Node) bool {
+	for a := n.Parent(); a != nil; a = a.Parent() {
+		if e, ok := a.(*ast.Emphasis); ok && e.Level == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve decodes backslash escapes and character references.
+func resolve(b []byte) string {
+	return string(util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(b))))
+}
+
+// printURL prints a link destination, in angle brackets if it contains any
+// of the dangerous strings.
+func printURL(url string, dangerous ...string) string {
+	for _, d := range dangerous {
+		if strings.Contains(url, d) {
+			return "<" + url + ">"
+		}
+	}
+	return url
+}
+
+func printTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	if strings.Contains(title, `"`) && strings.Contains(title, "'") && !strings.Contains(title, ")") {
+		return " (" + title + ")"
+	}
+	quote := `"`
+	if strings.Count(title, `"`) > strings.Count(title, "'") {
+		quote = "'"
+	}
+	title = strings.Replace(title, `\`, `\\`, 1)
+	title = strings.ReplaceAll(title, quote, `\`+quote)
+	return " " + quote + title + quote
+}
+
+// maxRun returns the length of the longest run of c in s.
+func maxRun(s string, c byte) int {
+	longest, run := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
+
+// minAbsentRun returns the shortest run length of c that doesn't occur in
+// s, or 0 if c doesn't occur at all.
+func minAbsentRun(s string, c byte) int {
+	present := make(map[int]bool)
+	run := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] == c {
+			run++
+			continue
+		}
+		if run > 0 {
+			present[run] = true
+		}
+		run = 0
+	}
+	if len(present) == 0 {
+		return 0
+	}
+	for i := 1; ; i++ {
+		if !present[i] {
+			return i
+		}
+	}
+}
+
+// stringWidth returns the number of columns s takes up in a terminal,
+// counting wide East Asian characters and emoji as two columns.
+func stringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		switch {
+		case r < 0x20, r >= 0x7f && r < 0xa0, unicode.Is(unicode.Mn, r), r == 0x200d, r >= 0xfe00 && r <= 0xfe0f:
+		case isWide(r):
+			width += 2
+		default:
+			width++
+		}
+	}
+	return width
+}
+
+func isWide(r rune) bool {
+	return r >= 0x1100 && (r <= 0x115f ||
+		r == 0x2329 || r == 0x232a ||
+		0x2e80 <= r && r <= 0x3247 && r != 0x303f ||
+		0x3250 <= r && r <= 0x4dbf ||
+		0x4e00 <= r && r <= 0xa4c6 ||
+		0xa960 <= r && r <= 0xa97c ||
+		0xac00 <= r && r <= 0xd7a3 ||
+		0xf900 <= r && r <= 0xfaff ||
+		0xfe10 <= r && r <= 0xfe19 ||
+		0xfe30 <= r && r <= 0xfe6b ||
+		0xff01 <= r && r <= 0xff60 ||
+		0xffe0 <= r && r <= 0xffe6 ||
+		0x1b000 <= r && r <= 0x1b001 ||
+		0x1f200 <= r && r <= 0x1f251 ||
+		0x1f300 <= r && r <= 0x1f64f ||
+		0x1f900 <= r && r <= 0x1f9ff ||
+		0x20000 <= r && r <= 0x3fffd)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clamp(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
@@ -0,0 +1,88 @@
+package prettier
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conformanceOptions are the option sets the conformance cases are run with.
+// Each case in testdata/NAME.md has its expected output, as produced by the
+// embedded prettier, in testdata/NAME.VARIANT.golden.
+var conformanceOptions = map[string]map[string]interface{}{
+	"always":   {"parser": "markdown", "proseWrap": "always"},
+	"never":    {"parser": "markdown", "proseWrap": "never"},
+	"preserve": {"parser": "markdown", "proseWrap": "preserve"},
+	"narrow":   {"parser": "markdown", "proseWrap": "always", "printWidth": 40},
+}
+
+type conformanceCase struct {
+	name, variant string
+	options       map[string]interface{}
+	input         string
+	golden        string
+}
+
+func conformanceCases(t *testing.T) []conformanceCase {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []conformanceCase
+	for _, input := range inputs {
+		in, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		for variant, options := range conformanceOptions {
+			cases = append(cases, conformanceCase{
+				name:    name,
+				variant: variant,
+				options: options,
+				input:   string(in),
+				golden:  filepath.Join("testdata", name+"."+variant+".golden"),
+			})
+		}
+	}
+	return cases
+}
+
+func TestNativeConformance(t *testing.T) {
+	for _, c := range conformanceCases(t) {
+		c := c
+		t.Run(c.name+"/"+c.variant, func(t *testing.T) {
+			want, err := ioutil.ReadFile(c.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := newFormatter(c.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f.format(c.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from prettier\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestNativeUnsupported(t *testing.T) {
+	f, err := newFormatter(conformanceOptions["always"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{
+		"see [the docs][docs]\n\n[docs]: https://example.com\n",
+		"---\ntitle: front matter\n---\n\ntext\n",
+	} {
+		if _, err := f.format(in); err == nil {
+			t.Errorf("format(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package prettier
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// knownOptions are the options understood by the embedded prettier.
+var knownOptions = map[string]bool{
+	"arrowParens":                true,
+	"bracketSpacing":             true,
+	"embeddedLanguageFormatting": true,
+	"endOfLine":                  true,
+	"filepath":                   true,
+	"htmlWhitespaceSensitivity":  true,
+	"insertPragma":               true,
+	"jsxBracketSameLine":         true,
+	"jsxSingleQuote":             true,
+	"parser":                     true,
+	"printWidth":                 true,
+	"proseWrap":                  true,
+	"quoteProps":                 true,
+	"rangeEnd":                   true,
+	"rangeStart":                 true,
+	"requirePragma":              true,
+	"semi":                       true,
+	"singleQuote":                true,
+	"tabWidth":                   true,
+	"trailingComma":              true,
+	"useTabs":                    true,
+	"vueIndentScriptAndStyle":    true,
+}
+
+// CheckOptions reports options that prettier doesn't know, and invalid
+// values for the options that matter when formatting Markdown.
+func CheckOptions(options map[string]interface{}) error {
+	var unknown []string
+	for key := range options {
+		if !knownOptions[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown prettier options: %s", strings.Join(unknown, ", "))
+	}
+	if _, ok := options["parser"]; !ok {
+		return errors.New(`prettier option parser must be set to "markdown"`)
+	}
+	_, err := newFormatter(options)
+	return err
+}
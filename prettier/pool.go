@@ -0,0 +1,36 @@
+package prettier
+
+// Pool is a fixed set of Prettier instances, so that several messages can be
+// formatted at once. An instance can only format one message at a time.
+type Pool struct {
+	free chan *Prettier
+}
+
+// NewPool creates a pool of size instances, each created with options and limits.
+func NewPool(size int, options map[string]interface{}, limits Limits) (*Pool, error) {
+	if size < 1 {
+		size = 1
+	}
+	pool := &Pool{
+		free: make(chan *Prettier, size),
+	}
+	for i := 0; i < size; i++ {
+		p, err := New(options, limits)
+		if err != nil {
+			return nil, err
+		}
+		pool.free <- p
+	}
+	return pool, nil
+}
+
+// Get checks out an instance, waiting until one is free.
+// The instance must be returned with Put when the caller is done with it.
+func (pool *Pool) Get() *Prettier {
+	return <-pool.free
+}
+
+// Put returns an instance checked out with Get.
+func (pool *Pool) Put(p *Prettier) {
+	pool.free <- p
+}
@@ -1,7 +1,11 @@
+//go:build !nov8
+// +build !nov8
+
 package prettier
 
 import (
 	_ "embed" // Necessary for go:embed statements to work.
+	"time"
 
 	"rogchap.com/v8go"
 )
@@ -13,46 +17,120 @@ var standalone string
 var markdown string
 
 type Prettier struct {
-	v8ctx *v8go.Context
+	options map[string]interface{}
+	limits  Limits
+	v8ctx   *v8go.Context
+	// uses is how many messages v8ctx has formatted.
+	uses int
+	// stale is set when v8ctx must be replaced before it is used again.
+	stale bool
 }
 
-func New(options map[string]interface{}) (*Prettier, error) {
+func New(options map[string]interface{}, limits Limits) (*Prettier, error) {
+	ctx, err := newContext(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Prettier{
+		options: options,
+		limits:  limits,
+		v8ctx:   ctx,
+	}, nil
+}
+
+// newContext creates a V8 context, in its own isolate, with prettier loaded.
+func newContext(options map[string]interface{}) (*v8go.Context, error) {
 	ctx, err := v8go.NewContext()
 	if err != nil {
 		return nil, err
 	}
-	if _, err := ctx.RunScript(standalone, "standalone.js"); err != nil {
+	if err := setup(ctx, options); err != nil {
+		closeContext(ctx)
 		return nil, err
 	}
+	return ctx, nil
+}
+
+func setup(ctx *v8go.Context, options map[string]interface{}) error {
+	if _, err := ctx.RunScript(standalone, "standalone.js"); err != nil {
+		return err
+	}
 	if _, err := ctx.RunScript(markdown, "parser-markdown.js"); err != nil {
-		return nil, err
+		return err
 	}
-	if value, err := ctx.RunScript(`
+	value, err := ctx.RunScript(`
 	var options = {
 		"plugins":   prettierPlugins,
-	}; options`, "options.js"); err != nil {
-		return nil, err
-	} else {
-		obj, err := value.AsObject()
-		if err != nil {
-			return nil, err
+	}; options`, "options.js")
+	if err != nil {
+		return err
+	}
+	obj, err := value.AsObject()
+	if err != nil {
+		return err
+	}
+	for key, value := range options {
+		if i, ok := value.(int); ok {
+			// YAML decodes numbers like printWidth as int, which v8go can't convert.
+			value = float64(i)
 		}
-		for key, value := range options {
-			if err := obj.Set(key, value); err != nil {
-				return nil, err
-			}
+		if err := obj.Set(key, value); err != nil {
+			return err
 		}
 	}
-	return &Prettier{
-		v8ctx: ctx,
-	}, nil
+	return nil
+}
+
+// closeContext frees a context created by newContext, along with its isolate.
+func closeContext(ctx *v8go.Context) {
+	iso, _ := ctx.Isolate()
+	ctx.Close()
+	iso.Dispose()
+}
+
+// recycle replaces the V8 context with a fresh one.
+func (p *Prettier) recycle() error {
+	ctx, err := newContext(p.options)
+	if err != nil {
+		return err
+	}
+	closeContext(p.v8ctx)
+	p.v8ctx = ctx
+	p.uses = 0
+	p.stale = false
+	return nil
 }
 
 func (p *Prettier) Format(in string) (string, error) {
+	if err := p.limits.checkInput(in); err != nil {
+		return "", err
+	}
+	if p.stale || p.limits.MaxUses > 0 && p.uses >= p.limits.MaxUses {
+		if err := p.recycle(); err != nil {
+			return "", err
+		}
+	}
+	p.uses++
 	if err := p.v8ctx.Global().Set("input", in); err != nil {
 		return "", err
 	}
+	var timer *time.Timer
+	terminated := make(chan struct{})
+	if p.limits.Timeout > 0 {
+		iso, _ := p.v8ctx.Isolate()
+		timer = time.AfterFunc(p.limits.Timeout, func() {
+			iso.TerminateExecution()
+			close(terminated)
+		})
+	}
 	value, err := p.v8ctx.RunScript("prettier.format(input, options)", "<input>")
+	if timer != nil && !timer.Stop() {
+		// Don't trust a context that was terminated (or is about to be);
+		// replace it before the next message.
+		<-terminated
+		p.stale = true
+		return "", ErrTimeout
+	}
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,47 @@
+//go:build nov8
+// +build nov8
+
+package prettier
+
+import "time"
+
+// Prettier formats Markdown like prettier does, without embedding V8.
+// It is used instead of the JavaScript prettier when built with -tags nov8.
+type Prettier struct {
+	f      *formatter
+	limits Limits
+}
+
+func New(options map[string]interface{}, limits Limits) (*Prettier, error) {
+	f, err := newFormatter(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Prettier{f: f, limits: limits}, nil
+}
+
+func (p *Prettier) Format(in string) (string, error) {
+	if err := p.limits.checkInput(in); err != nil {
+		return "", err
+	}
+	if p.limits.Timeout <= 0 {
+		return p.f.format(in)
+	}
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := p.f.format(in)
+		done <- result{out, err}
+	}()
+	timer := time.NewTimer(p.limits.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timer.C:
+		return "", ErrTimeout
+	}
+}
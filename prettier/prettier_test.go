@@ -0,0 +1,79 @@
+//go:build !nov8
+// +build !nov8
+
+package prettier
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the conformance goldens with prettier's output")
+
+// TestConformance checks that the goldens match the embedded prettier, so
+// that TestNativeConformance compares against prettier's real behavior.
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceCases(t) {
+		c := c
+		t.Run(c.name+"/"+c.variant, func(t *testing.T) {
+			p, err := New(c.options, Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Format(c.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := ioutil.WriteFile(c.golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(c.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("golden is stale; rerun with -update\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	options := conformanceOptions["always"]
+	p, err := New(options, Limits{MaxInput: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Format("this message is too long"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Format of long input returned %v, want ErrTooLarge", err)
+	}
+
+	p, err = New(options, Limits{Timeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Format("some *text*"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Format with a tiny timeout returned %v, want ErrTimeout", err)
+	}
+	// The terminated context is replaced before formatting again.
+	p.limits.Timeout = time.Minute
+	if got, err := p.Format("some *text*"); err != nil || got != "some _text_\n" {
+		t.Errorf("Format after a timeout = %q, %v", got, err)
+	}
+
+	p, err = New(options, Limits{MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got, err := p.Format("some *text*"); err != nil || got != "some _text_\n" {
+			t.Errorf("Format #%d = %q, %v", i, got, err)
+		}
+	}
+}
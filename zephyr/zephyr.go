@@ -10,17 +10,13 @@ import (
 	"github.com/zephyr-im/zephyr-go"
 )
 
-type listener struct {
-	class, instance string
-	ch              chan<- *zephyr.Message
-}
-
 type Client struct {
 	session *zephyr.Session
 	kCtx    *krb5.Context
 
-	mu        sync.Mutex
-	listeners []listener
+	mu          sync.Mutex
+	messagesCh  chan<- zephyr.MessageReaderResult
+	personalsCh chan<- zephyr.MessageReaderResult
 }
 
 func NewClient() (*Client, error) {
@@ -47,45 +43,114 @@ func (c *Client) TicketExpirationTime() time.Time {
 
 func (c *Client) listen() {
 	for result := range c.session.Messages() {
-		// TODO: Do something with result.AuthStatus?
-		msg := result.Message
-		c.handleMessage(msg)
+		c.handleMessage(result)
 	}
 }
 
-func (c *Client) handleMessage(msg *zephyr.Message) {
-	class, instance := strings.ToLower(msg.Class), strings.ToLower(msg.Instance)
+func (c *Client) handleMessage(result zephyr.MessageReaderResult) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for _, l := range c.listeners {
-		if l.class == class && (l.instance == "*" || l.instance == instance) {
-			l.ch <- msg
+	if isPersonal(result.Message) {
+		if c.personalsCh != nil {
+			c.personalsCh <- result
 			return
 		}
+	} else if c.messagesCh != nil {
+		c.messagesCh <- result
+		return
+	}
+	log.Printf("unhandled message: %v", result.Message)
+}
+
+// Subscribe subscribes to a zephyr class and instance tuple.
+// To subscribe to all instances on a class, pass "*" as the instance.
+// Messages on the subscription are delivered to the channel returned by Listen.
+func (c *Client) Subscribe(class, instance string) error {
+	ack, err := c.session.SendSubscribeNoDefaults(c.kCtx, []zephyr.Subscription{{Class: class, Instance: instance}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Subscribed to (%q, %q): %#v", class, instance, ack)
+	return nil
+}
+
+// Unsubscribe cancels a subscription made with Subscribe.
+func (c *Client) Unsubscribe(class, instance string) error {
+	ack, err := c.session.SendUnsubscribe(c.kCtx, []zephyr.Subscription{{Class: class, Instance: instance}})
+	if err != nil {
+		return err
 	}
-	log.Printf("unhandled message: %v", msg)
+	log.Printf("Unsubscribed from (%q, %q): %#v", class, instance, ack)
+	return nil
 }
 
-// SubscribeAndListen starts listening to a zephyr class and instance tuple.
-// To listen for all instances on a class, pass "*" as the instance.
+// Listen returns a channel of all the non-personal messages received on the
+// client's subscriptions, along with whether they were authenticated.
 // Zephyr classes and instances are case-insensitive and messages of any case may be returned.
-func (c *Client) SubscribeAndListen(class, instance string) (<-chan *zephyr.Message, error) {
-	if ack, err := c.session.SendSubscribeNoDefaults(c.kCtx, []zephyr.Subscription{{Class: class, Instance: instance}}); err != nil {
+func (c *Client) Listen() <-chan zephyr.MessageReaderResult {
+	ch := make(chan zephyr.MessageReaderResult)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messagesCh = ch
+	return ch
+}
+
+// isPersonal reports whether msg was addressed to a specific user rather than
+// to everyone subscribed to its class and instance.
+// Messages to a class in another realm have a recipient of the form "@REALM".
+func isPersonal(msg *zephyr.Message) bool {
+	return msg.Recipient != "" && !strings.HasPrefix(msg.Recipient, "@")
+}
+
+// ListenPersonals subscribes to personal messages addressed to the client's principal.
+func (c *Client) ListenPersonals() (<-chan zephyr.MessageReaderResult, error) {
+	sub := zephyr.Subscription{Recipient: c.session.Sender(), Class: "message", Instance: "*"}
+	if ack, err := c.session.SendSubscribeNoDefaults(c.kCtx, []zephyr.Subscription{sub}); err != nil {
 		return nil, err
 	} else {
-		log.Printf("Subscribed to (%q, %q): %#v", class, instance, ack)
+		log.Printf("Subscribed to personals for %q: %#v", sub.Recipient, ack)
 	}
-	ch := make(chan *zephyr.Message)
+	ch := make(chan zephyr.MessageReaderResult)
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.listeners = append(c.listeners, listener{
-		class:    strings.ToLower(class),
-		instance: strings.ToLower(instance),
-		ch:       ch,
-	})
+	c.personalsCh = ch
 	return ch, nil
 }
 
+// SendPersonal sends an authenticated personal message from the client's principal to recipient.
+// If recipient has no realm, the client's realm is used. If instance is empty, "PERSONAL" is used.
+func (c *Client) SendPersonal(recipient, instance string, body []string) error {
+	if !strings.Contains(recipient, "@") {
+		recipient = recipient + "@" + c.session.Realm()
+	}
+	if instance == "" {
+		instance = "PERSONAL"
+	}
+	ack, err := c.session.SendMessage(c.kCtx, &zephyr.Message{
+		Header: zephyr.Header{
+			Kind:  zephyr.ACKED,
+			UID:   c.session.MakeUID(time.Now()),
+			Port:  c.session.Port(),
+			Class: "MESSAGE", Instance: instance,
+			OpCode:        "mattermost",
+			Sender:        c.session.Sender(),
+			Recipient:     recipient,
+			DefaultFormat: "http://mit.edu/df/",
+			SenderAddress: c.session.LocalAddr().IP,
+			Charset:       zephyr.CharsetUTF8,
+			OtherFields:   nil,
+		},
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("ack: %v", ack)
+	return nil
+}
+
+// SendMessage sends an unauthenticated message to a class and instance that
+// claims to be from sender.
 func (c *Client) SendMessage(sender, class, instance string, body []string) error {
 	ack, err := c.session.SendMessageUnauth(&zephyr.Message{
 		Header: zephyr.Header{
@@ -110,12 +175,41 @@ func (c *Client) SendMessage(sender, class, instance string, body []string) erro
 	return nil
 }
 
+// SendAuthenticatedMessage sends an authenticated message from the client's
+// principal to a class and instance.
+func (c *Client) SendAuthenticatedMessage(class, instance string, body []string) error {
+	ack, err := c.session.SendMessage(c.kCtx, &zephyr.Message{
+		Header: zephyr.Header{
+			Kind:  zephyr.ACKED,
+			UID:   c.session.MakeUID(time.Now()),
+			Port:  c.session.Port(),
+			Class: class, Instance: instance,
+			OpCode:        "mattermost",
+			Sender:        c.session.Sender(),
+			Recipient:     "",
+			DefaultFormat: "http://mit.edu/df/",
+			SenderAddress: c.session.LocalAddr().IP,
+			Charset:       zephyr.CharsetUTF8,
+			OtherFields:   nil,
+		},
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("ack: %v", ack)
+	return nil
+}
+
 func (c *Client) Close() {
 	c.session.SendCancelSubscriptions(c.kCtx)
 	c.kCtx.Free()
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for _, l := range c.listeners {
-		close(l.ch)
+	if c.messagesCh != nil {
+		close(c.messagesCh)
+	}
+	if c.personalsCh != nil {
+		close(c.personalsCh)
 	}
 }